@@ -30,6 +30,10 @@ const (
 	PaxosClient AgentType = iota
 	// Paxos controller agent enum
 	PaxosController AgentType = iota
+	// Paxos leader agent enum
+	PaxosLeader AgentType = iota
+	// Paxos acceptor agent enum
+	PaxosAcceptor AgentType = iota
 )
 
 // Agent is an interface that all agents must implement
@@ -55,6 +59,34 @@ type Agent interface {
 	Halt()
 }
 
+// Reconfigurable is an interface that agents implement if they accept new
+// attributes while running, i.e. on a reload of the configuration of the grid
+type Reconfigurable interface {
+	// Reconfigure replaces the attributes of the agent with attrs. It is called
+	// after the new routes of the agent are in place
+	Reconfigure(attrs map[string]interface{})
+}
+
+// Migratable is an interface that agents implement if they can move to another
+// box while the grid runs
+type Migratable interface {
+	// Snapshot returns the state of the agent. It is called after Halt, when no
+	// message is delivered to the agent anymore
+	Snapshot() string
+
+	// Restore replaces the state of the agent with state, a snapshot. It is called
+	// after Init and before Run
+	Restore(state string)
+}
+
+// PeerObserver is an interface that agents implement to learn when the agents
+// they route to fail or recover, without heartbeats of their own
+type PeerObserver interface {
+	// OnPeerStatus tells that the box of the agent with virtual ID pid went up or
+	// down. It is called concurrently with Deliver
+	OnPeerStatus(pid c.ProcessID, up bool)
+}
+
 // AgentInfo is a struct containing data common to all agents.
 // It corresponds to the format of a JSON entry for an agent configuration.
 type AgentInfo struct {
@@ -83,6 +115,10 @@ func NewAgent(t AgentType) Agent {
 		return &paxos.ClientAgent{}
 	case PaxosController:
 		return &paxos.ControllerAgent{}
+	case PaxosLeader:
+		return &paxos.LeaderAgent{}
+	case PaxosAcceptor:
+		return &paxos.AcceptorAgent{}
 	default:
 		c.FatalOvidErrorf("Invalid agent type for agent %v\n", t)
 		return nil
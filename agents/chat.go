@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 
 	c "github.com/TonyZhangND/GoOvid/commons"
 )
@@ -21,6 +22,7 @@ type ChatAgent struct {
 	userName         string
 	contacts         []c.ProcessID
 	isActive         bool
+	mut              *sync.Mutex // mutex for userName and contacts
 }
 
 // Init fills the empty ca struct with this agent's fields and attributes.
@@ -31,12 +33,21 @@ func (ca *ChatAgent) Init(attrs map[string]interface{},
 	ca.send = send
 	ca.fatalAgentErrorf = fatalAgentErrorf
 	ca.debugPrintf = debugPrintf
-	ca.userName = attrs["myname"].(string)
-	ca.contacts = make([]c.ProcessID, len(attrs["contacts"].([]interface{})))
+	ca.mut = new(sync.Mutex)
+	ca.Reconfigure(attrs)
+	ca.isActive = false
+}
+
+// Reconfigure replaces the name and the contacts of ca with those of attrs.
+func (ca *ChatAgent) Reconfigure(attrs map[string]interface{}) {
+	contacts := make([]c.ProcessID, len(attrs["contacts"].([]interface{})))
 	for i, id := range attrs["contacts"].([]interface{}) {
-		ca.contacts[i] = c.ProcessID(id.(float64))
+		contacts[i] = c.ProcessID(id.(float64))
 	}
-	ca.isActive = false
+	ca.mut.Lock()
+	defer ca.mut.Unlock()
+	ca.userName = attrs["myname"].(string)
+	ca.contacts = contacts
 }
 
 // Halt stops the execution of ca.
@@ -53,6 +64,8 @@ func (ca *ChatAgent) Deliver(data string, port c.PortNum) {
 		return // ignore empty messages
 	}
 	sender, msg := dataSlice[0], dataSlice[1]
+	ca.mut.Lock()
+	defer ca.mut.Unlock()
 	fmt.Printf("\n%s > %s\n%s > ", sender, msg, ca.userName)
 }
 
@@ -61,7 +74,9 @@ func (ca *ChatAgent) Run() {
 	reader := bufio.NewReader(os.Stdin)
 	ca.isActive = true
 	for ca.isActive {
+		ca.mut.Lock()
 		fmt.Printf("%v > ", ca.userName)
+		ca.mut.Unlock()
 		// Read the keyboad input.
 		input, err := reader.ReadString('\n')
 		if err != nil {
@@ -69,8 +84,11 @@ func (ca *ChatAgent) Run() {
 			ca.fatalAgentErrorf("Invalid input %v in chatAgent\n", input)
 		}
 		if len(input) > 1 { // ignore empty messages, an empty msg is "\n"
-			for _, vDest := range ca.contacts {
-				ca.send(vDest, fmt.Sprintf("%s %s", ca.userName, strings.TrimSpace(input)))
+			ca.mut.Lock()
+			userName, contacts := ca.userName, ca.contacts
+			ca.mut.Unlock()
+			for _, vDest := range contacts {
+				ca.send(vDest, fmt.Sprintf("%s %s", userName, strings.TrimSpace(input)))
 			}
 		}
 	}
@@ -26,6 +26,7 @@ func (da *DummyAgent) Init(attrs map[string]interface{},
 	debugPrintf func(s string, a ...interface{})) {
 	da.send = send
 	da.fatalAgentErrorf = fatalAgentErrorf
+	da.debugPrintf = debugPrintf
 }
 
 // Halt stops the execution of *da.
@@ -42,3 +43,16 @@ func (da *DummyAgent) Deliver(data string, port c.PortNum) {
 
 // Run begins the execution of the *da agent.
 func (da *DummyAgent) Run() {}
+
+// Snapshot returns the state of *da, which has none.
+func (da *DummyAgent) Snapshot() string {
+	return ""
+}
+
+// OnPeerStatus logs that the peer pid of *da went up or down.
+func (da *DummyAgent) OnPeerStatus(pid c.ProcessID, up bool) {
+	da.debugPrintf("Peer %d is up: %v\n", pid, up)
+}
+
+// Restore restores the state of *da, which has none.
+func (da *DummyAgent) Restore(state string) {}
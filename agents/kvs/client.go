@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	c "github.com/TonyZhangND/GoOvid/commons"
+	h "github.com/TonyZhangND/GoOvid/history"
 )
 
 // ClientAgent struct contains the information inherent to a kvs agent
@@ -18,6 +19,8 @@ type ClientAgent struct {
 	debugPrintf      func(s string, a ...interface{})
 	isActive         bool
 	myID             c.ProcessID
+	history          *h.Recorder // records my operations if non-nil, see history/
+	nextOp           uint64      // number of the next operation in history
 }
 
 // Init fills the empty clt struct with this agent's fields and attributes.
@@ -30,11 +33,21 @@ func (clt *ClientAgent) Init(attrs map[string]interface{},
 	clt.debugPrintf = debugPrintf
 	clt.isActive = false
 	clt.myID = c.ProcessID(attrs["myid"].(float64))
+	if path, ok := attrs["history"].(string); ok {
+		recorder, err := h.NewRecorder(path, clt.myID)
+		if err != nil {
+			clt.fatalAgentErrorf("Cannot create history %s: %v\n", path, err)
+		}
+		clt.history = recorder
+	}
 }
 
 // Halt stops the execution of clt.
 func (clt *ClientAgent) Halt() {
 	clt.isActive = false
+	if clt.history != nil {
+		clt.history.Close()
+	}
 }
 
 // Deliver a message from either a tty or kvs agent
@@ -51,9 +64,17 @@ func (clt *ClientAgent) Deliver(request string, port c.PortNum) {
 	clt.debugPrintf("Client received request %s\n", request)
 	switch port {
 	case 1: //tty command -> forward to kvs
+		// The tty issues one command at a time, so the next response is to it
+		if clt.history != nil {
+			clt.history.Invoke(clt.nextOp, request)
+		}
 		msg := fmt.Sprintf("%v %s", clt.myID, request)
 		clt.send(2, msg)
 	case 2: //kvs response -> forward to tty
+		if clt.history != nil {
+			clt.history.Complete(clt.nextOp, request)
+			clt.nextOp++
+		}
 		repSlice := strings.SplitN(request, " ", 2)
 		switch repSlice[0] {
 		case "putok": //successful put
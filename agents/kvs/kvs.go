@@ -7,6 +7,7 @@ package kvs
 // Requirement: keys do not contain whitespace
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -99,3 +100,22 @@ func (kvs *ReplicaAgent) Deliver(request string, port c.PortNum) {
 func (kvs *ReplicaAgent) Run() {
 	kvs.isActive = true
 }
+
+// Snapshot returns the in-memory store of the halted kvs agent, in JSON.
+func (kvs *ReplicaAgent) Snapshot() string {
+	dat, err := json.Marshal(kvs.inMemoryStore)
+	if err != nil {
+		kvs.fatalAgentErrorf("Cannot snapshot store: %v\n", err)
+	}
+	return string(dat)
+}
+
+// Restore replaces the in-memory store of the kvs agent with the one of state.
+// The log is the one given by the attributes of the agent.
+func (kvs *ReplicaAgent) Restore(state string) {
+	store := make(map[string]string)
+	if err := json.Unmarshal([]byte(state), &store); err != nil {
+		kvs.fatalAgentErrorf("Cannot restore store from snapshot %s\n", state)
+	}
+	kvs.inMemoryStore = store
+}
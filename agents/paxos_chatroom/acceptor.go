@@ -1,10 +1,16 @@
 package paxos
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
 )
 
 // This file describes the states and transitions of a paxos replica that is related
@@ -13,53 +19,286 @@ import (
 type acceptorState struct {
 	ballotNum *ballot
 	accepted  map[uint64]string
-	amut      *sync.RWMutex // Mutex for accepted map
+	amut      *sync.RWMutex // Mutex for accepted map and ballotNum
 	// accepted is map of slot to p2aPayload (i.e. string describing pValue)
-	// "<leaderID> <bNum> <slot> <clientID> <reqNum> <m>"
+	// "<leaderID> <bNum> <slot> <clientID> <epoch> <reqNum> <m>"
+
+	// The acceptor log makes ballotNum and accepted durable. It is an append-only
+	// file of lines "ballot <ballotNum.id> <ballotNum.n>" and "accept <p2aPayload>".
+	// Every change is fsync'd before the acceptor replies to a leader.
+	// The log also has lines "lead <n>", for the ballot numbers of my own leader.
+	logFile *os.File // nil if the acceptor is not durable
+	led     uint64   // highest ballot number my leader used, 0 if none
+
+	// Every replica has executed all slots below stable, so the acceptor discarded
+	// their pValues
+	stable uint64
+
+	// Read lease granted to the leader of leaseHolder, see lease.go. Until
+	// leaseExpiry, the acceptor adopts no higher ballot of another leader.
+	// A nil leaseHolder with a future leaseExpiry blocks every leader
+	leaseHolder *ballot
+	leaseExpiry time.Time
 }
 
-// Constructor
+// Constructor. If the replica has a log path, the acceptor recovers its state
+// from the log, and makes all future changes durable in it
 func (rep *ReplicaAgent) newAcceptorState() *acceptorState {
-	return &acceptorState{
+	acc := &acceptorState{
 		accepted: make(map[uint64]string),
-		amut:     new(sync.RWMutex)}
+		amut:     new(sync.RWMutex),
+		stable:   0}
+	if rep.logPath == "" {
+		return acc
+	}
+	rep.recoverAcceptorState(acc)
+	if acc.ballotNum != nil {
+		// I may have granted a lease before crashing. Honor it
+		acc.leaseExpiry = time.Now().Add(leaseDuration)
+	}
+	logFile, err := os.OpenFile(rep.logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		rep.fatalAgentErrorf("Cannot open acceptor log %s: %v\n", rep.logPath, err)
+	}
+	acc.logFile = logFile
+	return acc
+}
+
+// Replays the acceptor log at rep.logPath into acc, if the log exists
+func (rep *ReplicaAgent) recoverAcceptorState(acc *acceptorState) {
+	f, err := os.Open(rep.logPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		rep.fatalAgentErrorf("Cannot open acceptor log %s: %v\n", rep.logPath, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		lSlice := strings.SplitN(line, " ", 2)
+		if len(lSlice) != 2 {
+			// A torn write at the tail of the log. The reply for it was never sent
+			rep.debugPrintf("Ignoring partial acceptor log entry '%s'\n", line)
+			continue
+		}
+		switch lSlice[0] {
+		case "ballot":
+			bSlice := strings.SplitN(lSlice[1], " ", 2)
+			if len(bSlice) != 2 {
+				continue
+			}
+			bID, err1 := strconv.ParseUint(bSlice[0], 10, 16)
+			bn, err2 := strconv.ParseUint(bSlice[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			b := &ballot{c.ProcessID(bID), bn}
+			if acc.ballotNum == nil || acc.ballotNum.lt(b) {
+				acc.ballotNum = b
+			}
+		case "accept":
+			if len(strings.SplitN(lSlice[1], " ", 7)) != 7 {
+				continue
+			}
+			pval := parsePValue(lSlice[1])
+			if acc.ballotNum == nil || acc.ballotNum.lt(pval.ballot) {
+				acc.ballotNum = pval.ballot.copy()
+			}
+			acc.accepted[pval.slot] = lSlice[1]
+		case "lead":
+			n, err := strconv.ParseUint(lSlice[1], 10, 64)
+			if err == nil && n > acc.led {
+				acc.led = n
+			}
+		default:
+			rep.debugPrintf("Ignoring invalid acceptor log entry '%s'\n", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		rep.fatalAgentErrorf("Cannot read acceptor log %s: %v\n", rep.logPath, err)
+	}
+	rep.debugPrintf("Recovered acceptor with ballot %v and %d accepted pValues\n",
+		acc.ballotNum, len(acc.accepted))
+}
+
+// Appends entry to the acceptor log and fsyncs it. No-op if the acceptor is not
+// durable. The caller must hold acc.amut
+func (rep *ReplicaAgent) persistAcceptorEntry(entry string) {
+	acc := rep.acceptor
+	if acc.logFile == nil {
+		return
+	}
+	if _, err := acc.logFile.WriteString(entry + "\n"); err != nil {
+		rep.fatalAgentErrorf("Cannot write acceptor log %s: %v\n", rep.logPath, err)
+	}
+	if err := acc.logFile.Sync(); err != nil {
+		rep.fatalAgentErrorf("Cannot sync acceptor log %s: %v\n", rep.logPath, err)
+	}
 }
 
-// Handle msg "p1a <sender> <balNum>"
+// Makes ballot number n of my leader durable before the leader uses it, so that a
+// restarted leader starts above it. No-op if the acceptor is not durable
+func (rep *ReplicaAgent) persistLeaderBallot(n uint64) {
+	acc := rep.acceptor
+	acc.amut.Lock()
+	defer acc.amut.Unlock()
+	if acc.logFile == nil || n <= acc.led {
+		return
+	}
+	acc.led = n
+	rep.persistAcceptorEntry(fmt.Sprintf("lead %d", n))
+}
+
+// Rewrites the acceptor log so that it only contains the current state, i.e. the
+// ballot and the pValues that have not been discarded. The caller must hold acc.amut
+func (rep *ReplicaAgent) compactAcceptorLog() {
+	acc := rep.acceptor
+	if acc.logFile == nil {
+		return
+	}
+	tmpPath := rep.logPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		rep.fatalAgentErrorf("Cannot create file %s: %v\n", tmpPath, err)
+	}
+	w := bufio.NewWriter(f)
+	for _, pValStr := range acc.accepted {
+		w.WriteString("accept " + pValStr + "\n")
+	}
+	if acc.ballotNum != nil {
+		w.WriteString(fmt.Sprintf("ballot %d %d\n", acc.ballotNum.id, acc.ballotNum.n))
+	}
+	if acc.led > 0 {
+		w.WriteString(fmt.Sprintf("lead %d\n", acc.led))
+	}
+	if err := w.Flush(); err != nil {
+		rep.fatalAgentErrorf("Error writing to file %s: %v\n", tmpPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		rep.fatalAgentErrorf("Cannot sync file %s: %v\n", tmpPath, err)
+	}
+	f.Close()
+	acc.logFile.Close()
+	if err := os.Rename(tmpPath, rep.logPath); err != nil {
+		rep.fatalAgentErrorf("Cannot replace acceptor log %s: %v\n", rep.logPath, err)
+	}
+	logFile, err := os.OpenFile(rep.logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		rep.fatalAgentErrorf("Cannot open acceptor log %s: %v\n", rep.logPath, err)
+	}
+	acc.logFile = logFile
+}
+
+// Garbage collects the pValues of the slots below stable, which every replica in
+// the current configuration has executed
+func (rep *ReplicaAgent) discardStable(stable uint64) {
+	acc := rep.acceptor
+	acc.amut.Lock()
+	defer acc.amut.Unlock()
+	if stable <= acc.stable {
+		return
+	}
+	acc.stable = stable
+	discarded := 0
+	for slot := range acc.accepted {
+		if slot < stable {
+			delete(acc.accepted, slot)
+			discarded++
+		}
+	}
+	if discarded > 0 {
+		rep.compactAcceptorLog()
+		rep.debugPrintf("Discarded %d pValues below stable slot %d\n", discarded, stable)
+	}
+}
+
+// Returns true iff an unexpired lease forbids adopting the higher ballot b.
+// The caller must hold acc.amut
+func (acc *acceptorState) leaseBlocks(b *ballot) bool {
+	if !time.Now().Before(acc.leaseExpiry) {
+		return false
+	}
+	return acc.leaseHolder == nil || acc.leaseHolder.id != b.id
+}
+
+// Handle msg "leasereq <balID> <balNum> <seq>". Grant the lease with
+// "leaseok <myID> <balID> <balNum> <seq>" iff ballot is the one I adopted
+func (rep *ReplicaAgent) handleLeaseRequest(s string) {
+	sSlice := strings.SplitN(s, " ", 4)
+	bID, _ := strconv.ParseUint(sSlice[1], 10, 64)
+	bn, _ := strconv.ParseUint(sSlice[2], 10, 64)
+	seq, _ := strconv.ParseUint(sSlice[3], 10, 64)
+	b := &ballot{c.ProcessID(bID), bn}
+	acc := rep.acceptor
+	acc.amut.Lock()
+	if acc.ballotNum == nil || !acc.ballotNum.eq(b) || acc.leaseBlocks(b) {
+		acc.amut.Unlock()
+		return
+	}
+	acc.leaseHolder = b
+	acc.leaseExpiry = time.Now().Add(leaseDuration)
+	acc.amut.Unlock()
+	rep.send(b.id, fmt.Sprintf("leaseok %d %d %d %d", rep.myID, b.id, b.n, seq))
+}
+
+// Handle msg "p1a <sender> <balNum> <checkpoint>"
 func (rep *ReplicaAgent) handleP1a(s string) {
 	rep.debugPrintf("Receive %s\n", s)
 	payload := strings.SplitN(s, " ", 2)[1]
-	leaderID, bNum := parseP1aPayload(payload)
+	leaderID, bNum, checkpoint := parseP1aPayload(payload)
 	newBallot := &ballot{leaderID, bNum}
-	if rep.acceptor.ballotNum == nil || rep.acceptor.ballotNum.lteq(newBallot) {
+	rep.acceptor.amut.Lock()
+	if (rep.acceptor.ballotNum == nil || rep.acceptor.ballotNum.lt(newBallot)) &&
+		!rep.acceptor.leaseBlocks(newBallot) {
 		rep.acceptor.ballotNum = newBallot
+		rep.persistAcceptorEntry(fmt.Sprintf("ballot %d %d", newBallot.id, newBallot.n))
+	}
+	// Respond with "p1b <myID> <ballotNum.id> <ballotNum.n> <stable> <json.Marshal(accepted)>",
+	// where accepted only has the slots the leader has yet to execute. Every slot
+	// below stable is decided, so the leader need not fill it
+	unexecuted := make(map[uint64]string)
+	for slot, pValStr := range rep.acceptor.accepted {
+		if slot >= checkpoint {
+			unexecuted[slot] = pValStr
+		}
 	}
-	// Respond with "p1b <myID> <ballotNum.id> <ballotNum.n> <json.Marshal(accepted)>"
-	rep.acceptor.amut.RLock()
-	m, _ := json.Marshal(rep.acceptor.accepted)
-	rep.acceptor.amut.RUnlock()
-	response := fmt.Sprintf("p1b %d %d %d %s",
+	m, _ := json.Marshal(unexecuted)
+	response := fmt.Sprintf("p1b %d %d %d %d %s",
 		rep.myID,
 		rep.acceptor.ballotNum.id,
 		rep.acceptor.ballotNum.n,
+		rep.acceptor.stable,
 		m)
+	rep.acceptor.amut.Unlock()
 	rep.send(leaderID, response)
 	rep.debugPrintf("Sent %s to %d\n", response, leaderID)
 }
 
-// Handle msg "p2a <balID> <balNum> <slot> <clientID> <reqNum> <m>"
+// Handle msg "p2a <balID> <balNum> <slot> <clientID> <epoch> <reqNum> <m>"
 func (rep *ReplicaAgent) handleP2a(s string) {
 	rep.debugPrintf("Receive p2a %s\n", s)
 	sSlice := strings.SplitN(s, " ", 2)
 	pval := parsePValue(sSlice[1])
-	if rep.acceptor.ballotNum == nil || rep.acceptor.ballotNum.lteq(pval.ballot) {
-		// Accept pVal if I did not promise some higher ballot
+	rep.acceptor.amut.Lock()
+	if pval.slot < rep.acceptor.stable {
+		// The slot is decided, and I discarded its pValue. Accepting another
+		// pValue could let a lagging replica learn a different decision
+		rep.acceptor.amut.Unlock()
+		rep.debugPrintf("Ignoring p2a for stable slot %d\n", pval.slot)
+		return
+	}
+	if rep.acceptor.ballotNum == nil ||
+		rep.acceptor.ballotNum.eq(pval.ballot) ||
+		(rep.acceptor.ballotNum.lt(pval.ballot) && !rep.acceptor.leaseBlocks(pval.ballot)) {
+		// Accept pVal if I did not promise some higher ballot, nor a lease
 		pValStr := sSlice[1]
 		newBal := &ballot{pval.ballot.id, pval.ballot.n}
 		rep.acceptor.ballotNum = newBal
-		rep.acceptor.amut.Lock()
 		rep.acceptor.accepted[pval.slot] = pValStr
-		rep.acceptor.amut.Unlock()
+		rep.persistAcceptorEntry("accept " + pValStr)
 	}
 	// Respond with "p2b <myID> <slot> <ballotNum.id> <ballotNum.n>"
 	response := fmt.Sprintf("p2b %d %d %d %d",
@@ -67,5 +306,6 @@ func (rep *ReplicaAgent) handleP2a(s string) {
 		pval.slot,
 		rep.acceptor.ballotNum.id,
 		rep.acceptor.ballotNum.n)
+	rep.acceptor.amut.Unlock()
 	rep.send(pval.ballot.id, response)
 }
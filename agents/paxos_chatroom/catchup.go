@@ -0,0 +1,113 @@
+package paxos
+
+// This file describes how a lagging replica catches up with its peers.
+// A leader broadcasts each decision once, so a replica that misses a decision
+// message would stall at that slot forever. Instead, a replica that makes no
+// progress while it knows of pending slots asks its peers for the decisions from
+// its slotOut onwards, in batches of up to catchUpBatch decisions. A peer that
+// truncated some of these decisions sends its latest checkpoint first.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Periodically checks whether I am stalled at slotOut while some later slot is
+// pending, and if so sends "fetch <myID> <slotOut>" to the other replicas
+func (rep *ReplicaAgent) runCatchUp() {
+	last := rep.getSlotOut()
+	for rep.isActive {
+		time.Sleep(catchUpInterval)
+		slotOut := rep.getSlotOut()
+		if slotOut == last && rep.isPending() {
+			rep.debugPrintf("Stalled at slot %d. Fetching decisions from peers\n", slotOut)
+			msg := fmt.Sprintf("fetch %d %d", rep.myID, slotOut)
+			for peer := range rep.replicasAt(slotOut) {
+				if peer != rep.myID {
+					rep.send(peer, msg)
+				}
+			}
+		}
+		last = slotOut
+	}
+}
+
+// Returns true iff I know of a slot beyond slotOut that is proposed or decided,
+// or of a request that waits to be proposed
+func (rep *ReplicaAgent) isPending() bool {
+	slotOut := rep.getSlotOut()
+	rep.rmut.RLock()
+	waiting := rep.slotIn > slotOut || len(rep.requests) > 0
+	rep.rmut.RUnlock()
+	if waiting {
+		return true
+	}
+	rep.dmut.RLock()
+	defer rep.dmut.RUnlock()
+	for slot := range rep.decisions {
+		if slot > slotOut {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle msg "fetch <replicaID> <from>". Respond with
+// "decisions <json.Marshal(slot -> chosen pValue)>" for the slots from onwards
+// that I know
+func (rep *ReplicaAgent) handleFetch(s string) {
+	sSlice := strings.SplitN(s, " ", 3)
+	if len(sSlice) != 3 {
+		rep.debugPrintf("Ignoring malformed fetch '%s'\n", s)
+		return
+	}
+	repID, _ := strconv.ParseUint(sSlice[1], 10, 16)
+	from, _ := strconv.ParseUint(sSlice[2], 10, 64)
+	if checkpoint := rep.checkpointSlot(); from < checkpoint {
+		// I no longer have the decisions below my checkpoint
+		rep.sendSnapshot(c.ProcessID(repID))
+		from = checkpoint
+	}
+	batch := make(map[uint64]string)
+	rep.dmut.RLock()
+	for slot := from; slot < from+catchUpBatch; slot++ {
+		if dec, ok := rep.decisions[slot]; ok {
+			batch[slot] = (&pValue{rep.slotInfo[slot].ballot, slot, dec}).String()
+		}
+	}
+	rep.dmut.RUnlock()
+	if len(batch) == 0 {
+		return
+	}
+	m, _ := json.Marshal(batch)
+	rep.send(c.ProcessID(repID), fmt.Sprintf("decisions %s", m))
+}
+
+// Handle msg "decisions <json.Marshal(slot -> chosen pValue)>" from a peer
+func (rep *ReplicaAgent) handleDecisionBatch(s string) {
+	var batch map[uint64]string
+	if err := json.Unmarshal([]byte(strings.SplitN(s, " ", 2)[1]), &batch); err != nil {
+		rep.debugPrintf("Ignoring malformed decisions '%s'\n", s)
+		return
+	}
+	learned := 0
+	for slot, d := range batch {
+		pval := parsePValue(d)
+		if pval.req == nil || pval.slot != slot {
+			rep.debugPrintf("Ignoring malformed decision '%s'\n", d)
+			continue
+		}
+		if rep.learnDecision(pval) {
+			learned++
+		}
+	}
+	if learned > 0 {
+		rep.debugPrintf("Caught up on %d decisions\n", learned)
+		rep.executeDecisions()
+	}
+}
@@ -0,0 +1,178 @@
+package paxos
+
+// This file describes the checkpoints of a paxos replica, and how the agents of the
+// service discard the state of the slots that every replica has executed.
+// Every checkpointInterval slots, a replica records a snapshot of its application
+// state, i.e. its chat log, session table and configurations, as of its slotOut.
+// It then drops the decisions below the checkpoint. A peer that asks for such a
+// decision to catch up is sent the snapshot instead.
+// Replicas also report their slotOut to acceptors and leaders. Every replica has
+// executed the slots below the stable slot, so acceptors discard their pValues and
+// leaders their proposals.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// a snapshot is the application state of a replica once it executed every slot
+// below Slot
+type snapshot struct {
+	Slot     uint64
+	ChatLog  []string
+	Sessions map[c.ProcessID]*session
+	Configs  map[uint64]map[c.ProcessID]int
+}
+
+// Returns the slot of my latest checkpoint, or 0 if I have none
+func (rep *ReplicaAgent) checkpointSlot() uint64 {
+	rep.kmut.RLock()
+	defer rep.kmut.RUnlock()
+	if rep.checkpoint == nil {
+		return 0
+	}
+	return rep.checkpoint.Slot
+}
+
+// Records a checkpoint of my state at slotOut, and drops the decisions and
+// proposals below it. Caller holds omut
+func (rep *ReplicaAgent) takeCheckpoint() {
+	slotOut := rep.getSlotOut()
+	rep.xmut.RLock()
+	snap := &snapshot{
+		Slot:     slotOut,
+		ChatLog:  make([]string, len(rep.chatLog)),
+		Sessions: rep.sessions.snapshot(),
+		Configs:  make(map[uint64]map[c.ProcessID]int)}
+	copy(snap.ChatLog, rep.chatLog)
+	rep.xmut.RUnlock()
+	rep.cmut.RLock()
+	for start, config := range rep.configs {
+		snap.Configs[start] = config
+	}
+	rep.cmut.RUnlock()
+	rep.kmut.Lock()
+	rep.checkpoint = snap
+	rep.kmut.Unlock()
+	rep.truncate(snap.Slot)
+	rep.debugPrintf("Checkpoint at slot %d\n", snap.Slot)
+}
+
+// Drops the decisions and proposals of the slots below slot. A proposal whose
+// request may not have been decided in its slot is put back into rep.requests
+func (rep *ReplicaAgent) truncate(slot uint64) {
+	rep.dmut.Lock()
+	for s := range rep.decisions {
+		if s < slot {
+			delete(rep.decisions, s)
+			delete(rep.slotInfo, s)
+		}
+	}
+	rep.dmut.Unlock()
+	rep.pmut.Lock()
+	for k, prop := range rep.proposals {
+		if prop.slot < slot {
+			delete(rep.proposals, k)
+			if _, status := rep.sessions.status(prop.req); status == reqNew {
+				rep.rmut.Lock()
+				rep.requests[prop.req.hash()] = prop.req
+				rep.rmut.Unlock()
+			}
+		}
+	}
+	rep.pmut.Unlock()
+}
+
+// Sends "snapshot <json.Marshal(checkpoint)>" to replica repID, if I have a checkpoint
+func (rep *ReplicaAgent) sendSnapshot(repID c.ProcessID) {
+	rep.kmut.RLock()
+	if rep.checkpoint == nil {
+		rep.kmut.RUnlock()
+		return
+	}
+	m, err := json.Marshal(rep.checkpoint)
+	rep.kmut.RUnlock()
+	if err != nil {
+		rep.fatalAgentErrorf("Cannot encode checkpoint: %v\n", err)
+	}
+	rep.send(repID, fmt.Sprintf("snapshot %s", m))
+}
+
+// Handle msg "snapshot <json.Marshal(checkpoint)>" from a peer. If the snapshot is
+// ahead of me, install it as my state and as my checkpoint
+func (rep *ReplicaAgent) handleSnapshot(s string) {
+	snap := &snapshot{}
+	if err := json.Unmarshal([]byte(strings.SplitN(s, " ", 2)[1]), snap); err != nil {
+		rep.debugPrintf("Ignoring malformed snapshot: %v\n", err)
+		return
+	}
+	// Install the whole snapshot under omut, so that no slot is executed against
+	// part of it
+	rep.omut.Lock()
+	if snap.Slot <= rep.getSlotOut() {
+		rep.omut.Unlock()
+		return
+	}
+	rep.debugPrintf("Installing snapshot at slot %d\n", snap.Slot)
+	rep.xmut.Lock()
+	rep.chatLog = make([]string, len(snap.ChatLog))
+	copy(rep.chatLog, snap.ChatLog)
+	rep.xmut.Unlock()
+	rep.sessions.restore(snap.Sessions)
+	rep.cmut.Lock()
+	rep.configs = snap.Configs
+	rep.cmut.Unlock()
+	rep.kmut.Lock()
+	rep.checkpoint = snap
+	rep.kmut.Unlock()
+	rep.dmut.Lock()
+	rep.slotOut = snap.Slot
+	rep.dmut.Unlock()
+	rep.truncate(snap.Slot)
+	rep.updateLeadership()
+	rep.omut.Unlock()
+	rep.executeDecisions()
+}
+
+// Handle msg "executed <replicaID> <slotOut>". Once every replica in the current
+// configuration has executed some slot, the pValues and proposals of the slots
+// below it are garbage collected
+func (rep *ReplicaAgent) handleExecuted(s string) {
+	payload := strings.SplitN(s, " ", 2)[1]
+	repID, slotOut := parseExecutedPayload(payload)
+	rep.emut.Lock()
+	if slotOut > rep.executed[repID] {
+		rep.executed[repID] = slotOut
+	}
+	stable := uint64(0)
+	first := true
+	for r := range rep.replicasAt(rep.getSlotOut()) {
+		slot, ok := rep.executed[r]
+		if !ok {
+			// Nothing is stable until every replica reported
+			rep.emut.Unlock()
+			return
+		}
+		if first || slot < stable {
+			stable = slot
+			first = false
+		}
+	}
+	if stable > rep.stable {
+		rep.stable = stable
+	}
+	rep.emut.Unlock()
+	if rep.hosts(roleAcceptor) {
+		rep.discardStable(stable)
+	}
+}
+
+// Returns the stable slot, below which every replica has executed every slot
+func (rep *ReplicaAgent) stableSlot() uint64 {
+	rep.emut.RLock()
+	defer rep.emut.RUnlock()
+	return rep.stable
+}
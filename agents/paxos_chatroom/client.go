@@ -5,12 +5,14 @@ package paxos
 
 import (
 	"fmt"
+	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	c "github.com/TonyZhangND/GoOvid/commons"
+	h "github.com/TonyZhangND/GoOvid/history"
 )
 
 // ClientAgent struct contains the information inherent to a paxos client
@@ -22,24 +24,37 @@ type ClientAgent struct {
 	isActive         bool
 
 	// Client attributes
-	myID     c.ProcessID
-	replicas map[c.ProcessID]int
-	mode     string // script or manual modes
+	myID          c.ProcessID
+	replicas      map[c.ProcessID]int
+	mode          string      // script or manual modes
+	outstanding   int         // max number of requests in flight at once
+	history       *h.Recorder // records my operations if non-nil, see history/
+	controller    c.ProcessID // controller to report status to, if hasController
+	hasController bool
 
 	// Client state
-	nextReqNum uint64
-	reqQueue   []*req
-	qmut       *sync.RWMutex
-	nmut       *sync.RWMutex
+	epoch       uint64 // epoch of my session, registrationEpoch until registered
+	nonce       uint64 // reqNum of my registration request
+	registered  chan string
+	nextReqNum  uint64
+	reqQueue    []*req          // requests waiting to be issued, in FIFO order
+	inFlight    map[uint64]*req // issued requests that are not yet committed, by reqNum
+	qmut        *sync.RWMutex   // mutex for reqQueue and inFlight
+	nmut        *sync.RWMutex
+	leader      c.ProcessID // replica believed to be the leader, if knowsLeader
+	knowsLeader bool
+	lmut        *sync.RWMutex // mutex for leader and knowsLeader
+	commits     uint64        // number of my writes committed, guarded by qmut
 }
 
 // req struct represents a client request
 type req struct {
 	reqNum          uint64
 	m               string
+	read            bool         // true iff req is a read-only command
 	ticker          *time.Ticker // used to mark intervals after which req should be re-issued
 	timeoutMultiple int
-	done            chan bool // used to inform mainThread that req has been committed
+	done            chan bool // used to inform the req's thread that req has been committed
 }
 
 // Init fills the empty client struct with this agent's fields and attributes.
@@ -63,77 +78,153 @@ func (clt *ClientAgent) Init(attrs map[string]interface{},
 	if clt.mode != "script" && clt.mode != "manual" {
 		clt.fatalAgentErrorf("Invalid mode '%s'\n", clt.mode)
 	}
+	clt.outstanding = 1
+	if n, ok := attrs["outstanding"].(float64); ok {
+		clt.outstanding = int(n)
+	}
+	if clt.outstanding < 1 {
+		clt.fatalAgentErrorf("Invalid number of outstanding requests %d\n", clt.outstanding)
+	}
+	if path, ok := attrs["history"].(string); ok {
+		recorder, err := h.NewRecorder(path, clt.myID)
+		if err != nil {
+			clt.fatalAgentErrorf("Cannot create history %s: %v\n", path, err)
+		}
+		clt.history = recorder
+	}
+	if ctr, ok := attrs["controller"].(float64); ok {
+		clt.controller, clt.hasController = c.ProcessID(ctr), true
+	}
 
 	// Initialize client state
+	// A restarted client starts over from reqNum 0, so it registers for a fresh
+	// epoch, identified by a random nonce, before issuing any requests
+	clt.epoch = registrationEpoch
+	clt.nonce = uint64(rand.New(rand.NewSource(time.Now().UnixNano())).Int63())
+	clt.registered = make(chan string, 1)
 	clt.nextReqNum = 0
 	clt.reqQueue = make([]*req, 0)
+	clt.inFlight = make(map[uint64]*req)
 	clt.qmut = new(sync.RWMutex)
 	clt.nmut = new(sync.RWMutex)
+	clt.knowsLeader = false
+	clt.lmut = new(sync.RWMutex)
 }
 
 // Halt stops the execution of the agent.
 func (clt *ClientAgent) Halt() {
 	clt.isActive = false
+	if clt.history != nil {
+		clt.history.Close()
+	}
 }
 
 // Deliver a message
 func (clt *ClientAgent) Deliver(request string, port c.PortNum) {
 	switch port {
 	case 1: // incoming msg from replica
-		msgSlice := strings.SplitN(request, " ", 3)
-		if msgSlice[0] != "committed" {
+		msgSlice := strings.SplitN(request, " ", 6)
+		header := msgSlice[0]
+		if (header != "committed" && header != "readok" && header != "redirect") ||
+			len(msgSlice) < 4 {
 			clt.fatalAgentErrorf(
 				"Received unexpected command '%s' in port %v\n",
 				request, port)
 		}
-		// Receive msg "committed <clientID> <reqNum>"
+		// Receive msg "committed <clientID> <epoch> <reqNum> <leaderHint> <result>",
+		// "readok <clientID> <epoch> <reqNum> <leaderHint> <result>", or
+		// "redirect <clientID> <epoch> <reqNum> <leaderHint>"
 		id, _ := strconv.ParseUint(msgSlice[1], 10, 64)
-		n, _ := strconv.ParseUint(msgSlice[2], 10, 64)
+		epoch, _ := strconv.ParseUint(msgSlice[2], 10, 64)
+		n, _ := strconv.ParseUint(msgSlice[3], 10, 64)
 		if c.ProcessID(id) != clt.myID {
 			clt.fatalAgentErrorf(
 				"Received unexpected commit response '%s'\n", request)
 		}
-
-		clt.qmut.RLock()
-		notEmpty := len(clt.reqQueue) > 0
-		matchReq := false
-		if notEmpty {
-			matchReq = clt.reqQueue[0].reqNum == n
+		leaderChanged := false
+		if len(msgSlice) > 4 {
+			hint, err := strconv.ParseUint(msgSlice[4], 10, 16)
+			if err == nil {
+				leaderChanged = clt.updateLeader(c.ProcessID(hint))
+			}
+		}
+		if epoch == registrationEpoch {
+			// Response to my registration. Its result is my new epoch
+			if header == "committed" && n == clt.nonce && len(msgSlice) == 6 {
+				select {
+				case clt.registered <- msgSlice[5]:
+				default:
+				}
+			}
+			return
+		}
+		clt.nmut.RLock()
+		myEpoch := clt.epoch
+		clt.nmut.RUnlock()
+		if epoch != myEpoch {
+			// Response to a request of a previous incarnation of me
+			return
 		}
-		clt.qmut.RUnlock()
-		if notEmpty && matchReq {
+		if header == "redirect" {
+			// Re-issue the request to the new leader right away
+			clt.qmut.RLock()
+			r, ok := clt.inFlight[n]
+			clt.qmut.RUnlock()
+			if ok && leaderChanged {
+				clt.sendToLeader(r)
+			}
+			return
+		}
+
+		// Responses may arrive in any order, so match against all requests in flight
+		clt.qmut.Lock()
+		r, ok := clt.inFlight[n]
+		if ok && r.read == (header == "readok") {
 			// If this is a response to a currently outstanding request,
 			// stop the ticker and declare the request as done
-			clt.qmut.Lock()
-			clt.reqQueue[0].ticker.Stop()
-			clt.reqQueue[0].done <- true
-			close(clt.reqQueue[0].done) // done with this request, close the channel
-			clt.reqQueue = clt.reqQueue[1:]
-			clt.qmut.Unlock()
+			if header == "readok" && len(msgSlice) == 6 {
+				clt.debugPrintf("Read %d : %s\n", n, msgSlice[5])
+			}
+			if clt.history != nil && len(msgSlice) == 6 {
+				clt.history.Complete(n, msgSlice[5])
+			}
+			if !r.read {
+				clt.commits++
+			}
+			r.ticker.Stop()
+			r.done <- true
+			close(r.done) // done with this request, close the channel
+			delete(clt.inFlight, n)
 		}
+		clt.qmut.Unlock()
 
 	case 9: // incoming msg from controller
-		// Receive msg "issue <m>"
+		// Receive msg "issue <m>", "read" or "status"
 		msgSlice := strings.SplitN(request, " ", 2)
-		if msgSlice[0] != "issue" {
+		if msgSlice[0] == "status" {
+			// Report "status client <myID> <commits>", see script.go
+			if clt.hasController {
+				clt.qmut.RLock()
+				commits := clt.commits
+				clt.qmut.RUnlock()
+				clt.send(clt.controller, fmt.Sprintf("status client %d %d", clt.myID, commits))
+			}
+			return
+		}
+		if (msgSlice[0] != "issue" || len(msgSlice) < 2) && msgSlice[0] != "read" {
 			clt.fatalAgentErrorf(
 				"Received unexpected command '%s' in unexpected port %v\n",
 				request, port)
 		}
+		m := "-"
+		if len(msgSlice) == 2 {
+			m = msgSlice[1]
+		}
 		// Append request to reqQueue
-		clt.nmut.RLock()
-		r := &req{
-			reqNum:          clt.nextReqNum,
-			m:               msgSlice[1],
-			done:            make(chan bool),
-			timeoutMultiple: 1}
-		clt.nmut.RUnlock()
+		r := clt.newReq(m, msgSlice[0] == "read")
 		clt.qmut.Lock()
 		clt.reqQueue = append(clt.reqQueue, r)
 		clt.qmut.Unlock()
-		clt.nmut.Lock()
-		clt.nextReqNum++
-		clt.nmut.Unlock()
 	default:
 		clt.fatalAgentErrorf("Received '%s' in unexpected port %v\n", request, port)
 	}
@@ -142,81 +233,187 @@ func (clt *ClientAgent) Deliver(request string, port c.PortNum) {
 // Run begins the execution of the paxos agent.
 func (clt *ClientAgent) Run() {
 	clt.isActive = true
+	clt.register()
 	if clt.mode == "script" {
 		go clt.runScriptMode()
 	}
 	clt.mainThread()
 }
 
+// Registers with the paxos service for a new epoch, by sending
+// "<clientID> <registrationEpoch> <nonce> register" to all replicas until one of
+// them responds with the epoch
+func (clt *ClientAgent) register() {
+	msg := fmt.Sprintf("%d %d %d register", clt.myID, registrationEpoch, clt.nonce)
+	ticker := time.NewTicker(timeoutDuration)
+	defer ticker.Stop()
+	for rep := range clt.replicas {
+		clt.send(rep, msg)
+	}
+	for clt.isActive {
+		select {
+		case e := <-clt.registered:
+			epoch, err := strconv.ParseUint(e, 10, 64)
+			if err != nil {
+				clt.fatalAgentErrorf("Received invalid epoch '%s'\n", e)
+			}
+			clt.nmut.Lock()
+			clt.epoch = epoch
+			clt.nmut.Unlock()
+			clt.debugPrintf("Registered for epoch %d\n", epoch)
+			return
+		case <-ticker.C:
+			for rep := range clt.replicas {
+				clt.send(rep, msg)
+			}
+		}
+	}
+}
+
+// Returns a new request with payload m, and the next request number
+func (clt *ClientAgent) newReq(m string, read bool) *req {
+	clt.nmut.Lock()
+	defer clt.nmut.Unlock()
+	r := &req{
+		reqNum: clt.nextReqNum,
+		m:      m,
+		read:   read,
+		// buffered, so that Deliver never waits on the request's thread
+		done:            make(chan bool, 1),
+		timeoutMultiple: 1}
+	clt.nextReqNum++
+	return r
+}
+
 func (clt *ClientAgent) runScriptMode() {
 	for clt.isActive {
-		clt.nmut.RLock()
-		r := &req{
-			reqNum:          clt.nextReqNum,
-			m:               fmt.Sprintf("(%d : %d)", clt.myID, clt.nextReqNum),
-			done:            make(chan bool),
-			timeoutMultiple: 1}
-		clt.nmut.RUnlock()
+		// Keep up to clt.outstanding requests queued or in flight
 		clt.qmut.Lock()
-		l := len(clt.reqQueue)
+		pending := len(clt.reqQueue) + len(clt.inFlight)
 		clt.qmut.Unlock()
-		if l == 0 {
+		if pending < clt.outstanding {
+			r := clt.newReq("", false)
+			r.m = fmt.Sprintf("(%d : %d)", clt.myID, r.reqNum)
+			clt.qmut.Lock()
 			clt.reqQueue = append(clt.reqQueue, r)
+			clt.qmut.Unlock()
 			continue
 		}
-		clt.nmut.Lock()
-		clt.nextReqNum++
-		clt.nmut.Unlock()
-		time.Sleep(commandInterval)
+		time.Sleep(sleepDuration)
 	}
 }
 
-// Main execution thread of client agent
+// Main execution thread of client agent. It issues queued requests in FIFO order
+// whenever fewer than clt.outstanding requests are in flight
 func (clt *ClientAgent) mainThread() {
 	for clt.isActive {
-		clt.qmut.RLock()
-		isEmpty := len(clt.reqQueue) == 0
-		clt.qmut.RUnlock()
-		if isEmpty {
-			// No pending requests. Take a break, have a KitKat
+		clt.qmut.Lock()
+		if len(clt.reqQueue) == 0 || len(clt.inFlight) >= clt.outstanding {
+			// Nothing to issue. Take a break, have a KitKat
+			clt.qmut.Unlock()
 			time.Sleep(sleepDuration)
-		} else {
-			// Process first message in queue
-			clt.qmut.RLock()
-			r := clt.reqQueue[0] // Outstanding request
-			clt.qmut.RUnlock()
+			continue
+		}
+		r := clt.reqQueue[0]
+		clt.reqQueue = clt.reqQueue[1:]
+		r.ticker = time.NewTicker(timeoutDuration)
+		clt.inFlight[r.reqNum] = r
+		clt.qmut.Unlock()
 
-			// Broadcast request "<clientID> <reqNum> <m>" to replicas
-			clt.debugPrintf("ISSUE request %d : '%s'\n", r.reqNum, r.m)
-			for rep := range clt.replicas {
-				clt.send(rep, fmt.Sprintf("%d %d %s", clt.myID, r.reqNum, r.m))
-			}
+		// Send request "<clientID> <epoch> <reqNum> <m>" to the leader
+		clt.debugPrintf("ISSUE request %d : '%s'\n", r.reqNum, r.m)
+		if clt.history != nil {
+			clt.history.Invoke(r.reqNum, clt.historyInput(r))
+		}
+		clt.sendToLeader(r)
+		go clt.awaitCommit(r)
+	}
+}
 
-			// Wait for request to be committed
-			r.ticker = time.NewTicker(timeoutDuration)
-			committed := false
-			for !committed {
-				select {
-				case <-r.done:
-					// Request committed
-					committed = true
-					clt.debugPrintf("COMMIT request %d : '%s'\n",
-						r.reqNum, r.m)
-				case <-r.ticker.C:
-					// Timer expired, resend request
-					// increment timer duration
-					r.timeoutMultiple++
-					duration := timeoutDuration
-					for i := 0; i < r.timeoutMultiple; i++ {
-						duration = duration * 2
-					}
-					r.ticker = time.NewTicker(duration)
-					clt.debugPrintf("Timeout for (%d, %d)\n", clt.myID, r.reqNum)
-					for rep := range clt.replicas {
-						clt.send(rep, fmt.Sprintf("%d %d %s", clt.myID, r.reqNum, r.m))
-					}
-				}
+// Waits for in-flight request r to be committed, re-issuing it on every timeout
+func (clt *ClientAgent) awaitCommit(r *req) {
+	clt.qmut.RLock()
+	ticker := r.ticker
+	clt.qmut.RUnlock()
+	for clt.isActive {
+		select {
+		case <-r.done:
+			// Request committed
+			clt.debugPrintf("COMMIT request %d : '%s'\n",
+				r.reqNum, r.m)
+			return
+		case <-ticker.C:
+			// Timer expired, resend request
+			// increment timer duration
+			r.timeoutMultiple++
+			duration := timeoutDuration
+			for i := 0; i < r.timeoutMultiple; i++ {
+				duration = duration * 2
+			}
+			ticker.Stop()
+			clt.qmut.Lock()
+			r.ticker = time.NewTicker(duration)
+			ticker = r.ticker
+			clt.qmut.Unlock()
+			// The leader may have failed. Fall back to broadcast until some
+			// replica tells me who the leader is
+			clt.debugPrintf("Timeout for (%d, %d)\n", clt.myID, r.reqNum)
+			clt.lmut.Lock()
+			clt.knowsLeader = false
+			clt.lmut.Unlock()
+			for rep := range clt.replicas {
+				clt.send(rep, clt.formatRequest(r))
 			}
 		}
 	}
 }
+
+// Returns r as an input of the log model of history/, i.e. "read", or
+// "append <entry>" where entry is the chat log entry that r appends
+func (clt *ClientAgent) historyInput(r *req) string {
+	if r.read {
+		return "read"
+	}
+	return fmt.Sprintf("append %d, %d : '%s'", clt.myID, r.reqNum, r.m)
+}
+
+// Formats r as "<clientID> <epoch> <reqNum> <m>", or
+// "read <clientID> <epoch> <reqNum> <m>" if r is read-only
+func (clt *ClientAgent) formatRequest(r *req) string {
+	clt.nmut.RLock()
+	epoch := clt.epoch
+	clt.nmut.RUnlock()
+	if r.read {
+		return fmt.Sprintf("read %d %d %d %s", clt.myID, epoch, r.reqNum, r.m)
+	}
+	return fmt.Sprintf("%d %d %d %s", clt.myID, epoch, r.reqNum, r.m)
+}
+
+// Sends r to the replica believed to be the leader, or to all replicas if the
+// leader is unknown
+func (clt *ClientAgent) sendToLeader(r *req) {
+	clt.lmut.RLock()
+	leader, knowsLeader := clt.leader, clt.knowsLeader
+	clt.lmut.RUnlock()
+	if knowsLeader {
+		clt.send(leader, clt.formatRequest(r))
+		return
+	}
+	for rep := range clt.replicas {
+		clt.send(rep, clt.formatRequest(r))
+	}
+}
+
+// Records hint as the leader if it is one of my replicas. Returns true iff my
+// belief of the leader changed
+func (clt *ClientAgent) updateLeader(hint c.ProcessID) bool {
+	if _, ok := clt.replicas[hint]; !ok {
+		return false
+	}
+	clt.lmut.Lock()
+	defer clt.lmut.Unlock()
+	changed := !clt.knowsLeader || clt.leader != hint
+	clt.leader = hint
+	clt.knowsLeader = true
+	return changed
+}
@@ -8,11 +8,12 @@ import (
 	"bufio"
 	"fmt"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 
 	c "github.com/TonyZhangND/GoOvid/commons"
+	"github.com/TonyZhangND/GoOvid/supervisor"
 )
 
 // ControllerAgent struct contains the information inherent to a controller
@@ -23,7 +24,10 @@ type ControllerAgent struct {
 	isActive         bool
 	clients          map[c.ProcessID]int // using map because we want search capability
 	replicas         map[c.ProcessID]int
-	alive            map[c.PortNum]int // map of ports to process ID, to keep track of processes manually started
+	boxes            *supervisor.Supervisor // boxes started by the 'start' command
+	nextReconfigNum  uint64                 // reqNum of the next reconfiguration command
+	script           []string               // lines of the scenario to run instead of stdin, see script.go
+	reports          *reports               // latest status reported by clients and replicas
 }
 
 // Init fills the empty ctr struct with this agent's fields and attributes.
@@ -36,7 +40,21 @@ func (ctr *ControllerAgent) Init(attrs map[string]interface{},
 	ctr.debugPrintf = debugPrintf
 	ctr.isActive = false
 
-	ctr.alive = make(map[c.PortNum]int)
+	boxes, err := supervisor.New()
+	if err != nil {
+		ctr.fatalAgentErrorf("Cannot supervise boxes: %v\n", err)
+		return
+	}
+	ctr.boxes = boxes
+	ctr.boxes.Restart, _ = attrs["restart"].(bool)
+	ctr.boxes.OnExit = func(box c.BoxID, err error) {
+		if err != nil {
+			fmt.Printf("Box %s exited : %v\n", box, err)
+		}
+	}
+	// Reconfigurations are all in the same epoch, so reqNums must stay unique
+	// across restarts of the controller
+	ctr.nextReconfigNum = uint64(time.Now().UnixNano())
 
 	// Parse and store attributes
 	ctr.clients, ctr.replicas = make(map[c.ProcessID]int), make(map[c.ProcessID]int)
@@ -48,6 +66,10 @@ func (ctr *ControllerAgent) Init(attrs map[string]interface{},
 		id := c.ProcessID(x.(float64))
 		ctr.replicas[id] = 0
 	}
+	ctr.reports = newReports()
+	if path, ok := attrs["script"].(string); ok {
+		ctr.script = readScript(path, ctr.fatalAgentErrorf)
+	}
 }
 
 // Halt stops the execution of the agent.
@@ -55,15 +77,25 @@ func (ctr *ControllerAgent) Halt() {
 	ctr.isActive = false
 }
 
-// Deliver a message
+// Deliver a message. Clients and replicas report their status on port 1 with
+// "status client <clientID> <commits>", "status replica <replicaID> <slotOut>" or
+// "dumped <replicaID> <path of structured dump>"
 func (ctr *ControllerAgent) Deliver(request string, port c.PortNum) {
-
+	if port != 1 {
+		ctr.fatalAgentErrorf("Received '%s' in unexpected port %v\n", request, port)
+		return
+	}
+	ctr.reports.handleReport(request)
 }
 
 // Run begins the execution of the paxos agent.
 func (ctr *ControllerAgent) Run() {
-	reader := bufio.NewReader(os.Stdin)
 	ctr.isActive = true
+	if ctr.script != nil {
+		ctr.runScript()
+		return
+	}
+	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("Paxos controller active. Enter your command")
 	for ctr.isActive {
 		fmt.Printf("> ")
@@ -78,131 +110,169 @@ func (ctr *ControllerAgent) Run() {
 			// Ignore empty messages
 			continue
 		}
-		inputSlice := strings.SplitN(strings.TrimSpace(input), " ", 2)
-		command := inputSlice[0]
-		switch command {
-		case "exit":
-			fmt.Println("Terminating paxos cluster")
-			ctr.Halt()
-			os.Exit(0)
-		case "start":
-			// Start a node
-			if len(inputSlice) < 2 {
-				fmt.Println("Invalid input")
-				continue
-			}
-			payload := strings.SplitN(inputSlice[1], " ", 2)
-			if len(payload) < 2 {
-				fmt.Println("Invalid input")
-				continue
-			}
-			nodePort, err := strconv.ParseUint(payload[0], 10, 64)
-			if err != nil {
-				fmt.Println("Invalid input")
-				continue
-			}
-			loss, err := strconv.ParseFloat(payload[1], 64)
-			if err != nil || loss < 0 || loss > 1 {
-				fmt.Printf("Invalid input : %v\n", err)
-				continue
-			}
-			box := fmt.Sprintf("127.0.0.1:%d", nodePort)
-			proc := exec.Command("./ovid",
-				"-log", fmt.Sprintf("-loss=%f", loss), "configs/paxos.json", box)
-			proc.Stdout = os.Stdout
-			err = proc.Start()
-			if err != nil {
-				fmt.Printf("Failed to start 127.0.0.1:%d : %v\n", nodePort, err)
-				continue
-			}
-			ctr.alive[c.PortNum(nodePort)] = proc.Process.Pid
-			fmt.Printf("Started box 127.0.0.1:%d, pid = %d, loss=%f\n", nodePort, proc.Process.Pid, loss)
-		case "req":
-			// Issue a client request
-			if len(inputSlice) < 2 {
-				fmt.Println("Invalid input")
-				continue
-			}
-			payload := strings.SplitN(inputSlice[1], " ", 2)
-			if len(payload) < 2 {
-				fmt.Println("Invalid input")
-				continue
-			}
-			destUint, err := strconv.ParseUint(payload[0], 10, 64)
-			if err != nil {
-				fmt.Printf("Invalid request destination %v\n", payload[0])
-			}
-			dest := c.ProcessID(destUint)
-			_, ok := ctr.clients[dest]
-			if !ok {
-				fmt.Printf("Invalid client %v\n", dest)
-				continue
-			}
-			m := payload[1]
-			ctr.send(dest, fmt.Sprintf("issue %s", m))
-		case "kill":
-			// Issue a kill command
-			if len(inputSlice) < 2 {
-				fmt.Println("Invalid input")
-				continue
-			}
-			nodePort, err := strconv.ParseUint(inputSlice[1], 10, 64)
-			if err != nil {
-				fmt.Println("Invalid input")
-				continue
-			}
-			pid, ok := ctr.alive[c.PortNum(nodePort)]
-			if !ok {
-				fmt.Printf("Box 127.0.0.1:%d is already dead\n", nodePort)
-				continue
-			}
-			// proc := exec.Command("./ovid", "-log", "configs/paxos.json", box)
-			proc := exec.Command("kill", "-9", strconv.FormatInt(int64(pid), 10))
-			proc.Stdout = os.Stdout
-			err = proc.Start()
-			if err != nil {
-				fmt.Printf("Failed to kill 127.0.0.1:%d : %v\n", nodePort, err)
-				continue
-			}
-			delete(ctr.alive, c.PortNum(nodePort))
-			fmt.Printf("Killed box 127.0.0.1:%d, pid = %d\n", nodePort, proc.Process.Pid)
-		case "dump":
-			if len(inputSlice) > 1 {
-				fmt.Println("Invalid input")
-				continue
-			}
-			for rep := range ctr.replicas {
-				ctr.send(rep, fmt.Sprintf("dump"))
-			}
-		case "skip":
-			if len(inputSlice) < 2 {
-				fmt.Println("Invalid input")
-				continue
-			}
-			payload := strings.SplitN(inputSlice[1], " ", 2)
-			if len(payload) < 2 {
-				fmt.Println("Invalid input")
-				continue
-			}
-			destUint, err := strconv.ParseUint(payload[0], 10, 64)
-			if err != nil {
-				fmt.Printf("Invalid request destination %v\n", payload[0])
-			}
-			dest := c.ProcessID(destUint)
-			_, ok := ctr.replicas[dest]
-			if !ok {
-				fmt.Printf("Invalid replica %v\n", dest)
-				continue
-			}
-			slot, err := strconv.ParseUint(payload[1], 10, 64)
-			if err != nil {
-				fmt.Printf("Invalid slot %v\n", inputSlice[1])
-				continue
-			}
-			ctr.send(dest, fmt.Sprintf("skip %d", slot))
-		default:
-			fmt.Println("Invalid command")
-			continue
+		ctr.handleCommand(input)
+	}
+}
+
+// Executes controller command input. Returns false iff input is invalid
+func (ctr *ControllerAgent) handleCommand(input string) bool {
+	inputSlice := strings.SplitN(strings.TrimSpace(input), " ", 2)
+	command := inputSlice[0]
+	switch command {
+	case "exit":
+		fmt.Println("Terminating paxos cluster")
+		ctr.boxes.StopAll()
+		ctr.Halt()
+		os.Exit(0)
+	case "start":
+		// Start a node
+		if len(inputSlice) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		payload := strings.SplitN(inputSlice[1], " ", 2)
+		if len(payload) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		box, err := ctr.boxes.Resolve(payload[0])
+		if err != nil {
+			fmt.Printf("Invalid input : %v\n", err)
+			return false
+		}
+		loss, err := strconv.ParseFloat(payload[1], 64)
+		if err != nil || loss < 0 || loss > 1 {
+			fmt.Printf("Invalid input : %v\n", err)
+			return false
+		}
+		pid, err := ctr.boxes.Start(box, "-log", fmt.Sprintf("-loss=%f", loss))
+		if err != nil {
+			fmt.Printf("Failed to start %s : %v\n", box, err)
+			return false
+		}
+		fmt.Printf("Started box %s, pid = %d, loss=%f\n", box, pid, loss)
+	case "req":
+		// Issue a client request
+		if len(inputSlice) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		payload := strings.SplitN(inputSlice[1], " ", 2)
+		if len(payload) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		destUint, err := strconv.ParseUint(payload[0], 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid request destination %v\n", payload[0])
+			return false
+		}
+		dest := c.ProcessID(destUint)
+		_, ok := ctr.clients[dest]
+		if !ok {
+			fmt.Printf("Invalid client %v\n", dest)
+			return false
+		}
+		m := payload[1]
+		ctr.send(dest, fmt.Sprintf("issue %s", m))
+	case "read":
+		// Issue a read-only client request, served under the leader's lease
+		if len(inputSlice) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		destUint, err := strconv.ParseUint(strings.TrimSpace(inputSlice[1]), 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid request destination %v\n", inputSlice[1])
+			return false
+		}
+		dest := c.ProcessID(destUint)
+		if _, ok := ctr.clients[dest]; !ok {
+			fmt.Printf("Invalid client %v\n", dest)
+			return false
+		}
+		ctr.send(dest, "read")
+	case "kill":
+		// Issue a kill command
+		if len(inputSlice) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		box, err := ctr.boxes.Resolve(inputSlice[1])
+		if err != nil {
+			fmt.Printf("Invalid input : %v\n", err)
+			return false
+		}
+		pid, ok := ctr.boxes.Pid(box)
+		if !ok {
+			fmt.Printf("Box %s is already dead\n", box)
+			return false
+		}
+		ctr.boxes.Stop(box)
+		fmt.Printf("Killed box %s, pid = %d\n", box, pid)
+	case "dump":
+		if len(inputSlice) > 1 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		ctr.reports.clearDumps()
+		for rep := range ctr.replicas {
+			ctr.send(rep, fmt.Sprintf("dump"))
+		}
+	case "skip":
+		if len(inputSlice) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		payload := strings.SplitN(inputSlice[1], " ", 2)
+		if len(payload) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		destUint, err := strconv.ParseUint(payload[0], 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid request destination %v\n", payload[0])
+			return false
+		}
+		dest := c.ProcessID(destUint)
+		_, ok := ctr.replicas[dest]
+		if !ok {
+			fmt.Printf("Invalid replica %v\n", dest)
+			return false
+		}
+		slot, err := strconv.ParseUint(payload[1], 10, 64)
+		if err != nil {
+			fmt.Printf("Invalid slot %v\n", inputSlice[1])
+			return false
+		}
+		ctr.send(dest, fmt.Sprintf("skip %d", slot))
+	case "reconfig":
+		// Issue "reconfig <add|remove> <replicaID>". The replica being
+		// added must already be routable from every replica and client
+		if len(inputSlice) < 2 {
+			fmt.Println("Invalid input")
+			return false
+		}
+		op, id, ok := parseReconfigPayload(inputSlice[1])
+		if !ok {
+			fmt.Println("Invalid input")
+			return false
+		}
+		if _, isReplica := ctr.replicas[id]; op == "remove" && !isReplica {
+			fmt.Printf("Invalid replica %v\n", id)
+			return false
+		}
+		for rep := range ctr.replicas {
+			ctr.send(rep, fmt.Sprintf("reconfig %d %s %d", ctr.nextReconfigNum, op, id))
+		}
+		ctr.nextReconfigNum++
+		if op == "add" {
+			ctr.replicas[id] = 0
 		}
+		fmt.Printf("Issued reconfiguration '%s %d'\n", op, id)
+	default:
+		fmt.Println("Invalid command")
+		return false
 	}
+	return true
 }
@@ -0,0 +1,194 @@
+package paxos
+
+// This file describes the structured dump of a paxos replica, and the checker that
+// compares the dumps of the replicas of a service.
+// On the controller's 'dump' command, a replica writes <output>.json, which holds,
+// for every slot from its latest checkpoint on that it knows the decision of, the
+// decided request, the ballot it was chosen in, and whether it was executed, along
+// with the replica's session table.
+// CheckDumps verifies that the replicas agree on every slot they both know, that no
+// request is executed twice, and that each client's requests are executed in order.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Execution status of a decided slot
+const (
+	slotPending      = "pending"      // the slot has not been executed yet
+	slotExecuted     = "executed"     // the request was performed on the chat log
+	slotDuplicate    = "duplicate"    // the request was executed in an earlier slot
+	slotSkipped      = "skipped"      // the request was of a stale or future epoch
+	slotNoop         = "noop"         // a leader filled the slot with a no-op
+	slotReconfig     = "reconfig"     // the request changed the configuration
+	slotRegistration = "registration" // the request started a client epoch
+)
+
+// slotInfo is what a replica knows of a decided slot besides its request
+type slotInfo struct {
+	ballot *ballot // ballot the decision was chosen in
+	status string  // execution status
+}
+
+// SlotDump is the state of one decided slot of a replica
+type SlotDump struct {
+	Slot     uint64
+	ClientID c.ProcessID
+	Epoch    uint64
+	ReqNum   uint64
+	Payload  string
+	Ballot   string // "<leaderID>.<balNum>"
+	Status   string
+}
+
+// Dump is the structured state of a replica
+type Dump struct {
+	Replica    c.ProcessID
+	SlotOut    uint64
+	Checkpoint uint64     // slots below Checkpoint are not in Slots
+	Slots      []SlotDump // sorted by slot
+	Sessions   map[c.ProcessID]*session
+}
+
+// Returns my structured dump
+func (rep *ReplicaAgent) dump() *Dump {
+	d := &Dump{
+		Replica:    rep.myID,
+		Checkpoint: rep.checkpointSlot(),
+		Slots:      make([]SlotDump, 0),
+		Sessions:   rep.sessions.snapshot()}
+	rep.dmut.Lock()
+	d.SlotOut = rep.slotOut
+	for slot, req := range rep.decisions {
+		info := rep.slotInfo[slot]
+		d.Slots = append(d.Slots, SlotDump{
+			Slot:     slot,
+			ClientID: req.clientID,
+			Epoch:    req.epoch,
+			ReqNum:   req.reqNum,
+			Payload:  req.payload,
+			Ballot:   fmt.Sprintf("%d.%d", info.ballot.id, info.ballot.n),
+			Status:   info.status})
+	}
+	rep.dmut.Unlock()
+	sort.Slice(d.Slots, func(i, j int) bool { return d.Slots[i].Slot < d.Slots[j].Slot })
+	return d
+}
+
+// Writes my structured dump to path
+func (rep *ReplicaAgent) writeDump(path string) {
+	bytes, err := json.MarshalIndent(rep.dump(), "", "  ")
+	if err != nil {
+		rep.fatalAgentErrorf("Error marshalling dump: %v\n", err)
+		return
+	}
+	if err = ioutil.WriteFile(path, bytes, 0644); err != nil {
+		rep.fatalAgentErrorf("Error writing to file %s: %v\n", path, err)
+	}
+}
+
+// ReadDump reads the structured dump of a replica from path
+func ReadDump(path string) (*Dump, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := new(Dump)
+	if err = json.Unmarshal(bytes, d); err != nil {
+		return nil, fmt.Errorf("invalid dump %s: %v", path, err)
+	}
+	return d, nil
+}
+
+// Returns true iff the slot has been executed by its replica
+func (s *SlotDump) isExecuted() bool {
+	return s.Status != slotPending
+}
+
+// CheckDumps verifies the dumps of the replicas of a service, and returns a
+// description of every violation it finds. Clients have at most outstanding
+// requests in flight, so a request may be executed after a later one of its
+// client as long as their reqNums differ by less than outstanding.
+func CheckDumps(dumps []*Dump, outstanding int) []string {
+	errs := make([]string, 0)
+
+	// Agreement: replicas that know the decision of a slot agree on its request,
+	// and on its status if both executed it
+	first := make(map[uint64]*SlotDump)     // slot -> first dump of it
+	firstBy := make(map[uint64]c.ProcessID) // slot -> replica of first dump
+	for _, d := range dumps {
+		for i := range d.Slots {
+			s := &d.Slots[i]
+			f, ok := first[s.Slot]
+			if !ok {
+				first[s.Slot], firstBy[s.Slot] = s, d.Replica
+				continue
+			}
+			if f.ClientID != s.ClientID || f.Epoch != s.Epoch || f.ReqNum != s.ReqNum ||
+				f.Payload != s.Payload {
+				errs = append(errs, fmt.Sprintf(
+					"slot %d: replica %d decided (%d, %d, %d, '%s'), replica %d decided (%d, %d, %d, '%s')",
+					s.Slot, firstBy[s.Slot], f.ClientID, f.Epoch, f.ReqNum, f.Payload,
+					d.Replica, s.ClientID, s.Epoch, s.ReqNum, s.Payload))
+			} else if f.isExecuted() && s.isExecuted() && f.Status != s.Status {
+				errs = append(errs, fmt.Sprintf(
+					"slot %d: replica %d executed it as %s, replica %d as %s",
+					s.Slot, firstBy[s.Slot], f.Status, d.Replica, s.Status))
+			}
+		}
+	}
+
+	for _, d := range dumps {
+		// No duplicate execution, and per-client order
+		type reqID struct {
+			cid       c.ProcessID
+			epoch, rn uint64
+		}
+		type clientEpoch struct {
+			cid   c.ProcessID
+			epoch uint64
+		}
+		executedAt := make(map[reqID]uint64)      // request -> slot it was executed in
+		maxReqNum := make(map[clientEpoch]uint64) // client epoch -> highest reqNum executed
+		for i := range d.Slots {
+			s := &d.Slots[i]
+			if s.Status != slotExecuted {
+				continue
+			}
+			id := reqID{s.ClientID, s.Epoch, s.ReqNum}
+			if slot, ok := executedAt[id]; ok {
+				errs = append(errs, fmt.Sprintf(
+					"replica %d: request (%d, %d, %d) executed in slots %d and %d",
+					d.Replica, s.ClientID, s.Epoch, s.ReqNum, slot, s.Slot))
+				continue
+			}
+			executedAt[id] = s.Slot
+			ce := clientEpoch{s.ClientID, s.Epoch}
+			if max, ok := maxReqNum[ce]; ok && s.ReqNum < max &&
+				max-s.ReqNum >= uint64(outstanding) {
+				errs = append(errs, fmt.Sprintf(
+					"replica %d: request (%d, %d, %d) executed in slot %d after reqNum %d",
+					d.Replica, s.ClientID, s.Epoch, s.ReqNum, s.Slot, max))
+			}
+			if max, ok := maxReqNum[ce]; !ok || s.ReqNum > max {
+				maxReqNum[ce] = s.ReqNum
+			}
+		}
+		// Every request executed above the checkpoint is recorded in the sessions
+		for id, slot := range executedAt {
+			sess, ok := d.Sessions[id.cid]
+			if ok && sess.Epoch == id.epoch && !sess.isExecuted(id.rn) &&
+				slot < d.SlotOut {
+				errs = append(errs, fmt.Sprintf(
+					"replica %d: request (%d, %d, %d) of slot %d missing from its sessions",
+					d.Replica, id.cid, id.epoch, id.rn, slot))
+			}
+		}
+	}
+	return errs
+}
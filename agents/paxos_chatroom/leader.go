@@ -5,7 +5,7 @@ package paxos
 
 import (
 	"fmt"
-	"math"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,6 +13,12 @@ import (
 	c "github.com/TonyZhangND/GoOvid/commons"
 )
 
+// an adoption is what a scout reports to its leader when adopted
+type adoption struct {
+	pmax  map[uint64]pValue // slot -> pValue with highest ballot accepted
+	floor uint64            // every slot below floor is decided
+}
+
 type leaderState struct {
 	ballotNum     *ballot
 	active        bool
@@ -20,48 +26,109 @@ type leaderState struct {
 	proposeInChan chan proposal          // channel into which replica pushes proposals
 	p1bOutChan    chan string            // channel into which leader pushes p1b to scout
 	p2bOutChans   map[uint64]chan string // channels into which leader pushes p1b to commanders
-	p2bMut        *sync.RWMutex          // mutex for p2bOutChans map
+	p2bMut        *sync.RWMutex          // mutex for p1bOutChan and p2bOutChans map
+
+	// Every slot below floor is decided, see adoption and the stable slot
+	floor uint64
+	// stop is closed when the leader is preempted, to cancel the scout and the
+	// commanders of its ballot. It is then replaced for those of the next ballot
+	stop chan struct{}
+	// holes[s] is true iff slot s had no proposal at the last check for holes.
+	// A slot that stays a hole for holeTimeout is filled with a no-op
+	holes map[uint64]bool
 }
 
 // Constructor
 func (rep *ReplicaAgent) newLeaderState() *leaderState {
 	return &leaderState{
-		ballotNum:     &ballot{rep.myID, 0},
+		ballotNum:     &ballot{rep.myID, rep.firstBallotNum()},
 		active:        false,
 		proposals:     make(map[uint64]*proposal),
 		proposeInChan: make(chan proposal, bufferSize),
-		p2bMut:        new(sync.RWMutex)}
+		p2bMut:        new(sync.RWMutex),
+		holes:         make(map[uint64]bool),
+		stop:          make(chan struct{})}
+}
+
+// Returns the number of the first ballot of my leader. A restarted leader must
+// never reuse a ballot of an earlier incarnation, as acceptors accept any pValue
+// of the ballot they adopted. So a durable leader starts above the ballots in its
+// log, and a leader that is not durable relies on the clock
+func (rep *ReplicaAgent) firstBallotNum() uint64 {
+	acc := rep.acceptor
+	if acc.logFile == nil {
+		return uint64(time.Now().UnixNano())
+	}
+	n := acc.led
+	if acc.ballotNum != nil && acc.ballotNum.id == rep.myID && acc.ballotNum.n > n {
+		n = acc.ballotNum.n
+	}
+	return n + 1
+}
+
+// Returns the replica whose leader is believed to be active, for clients to send
+// requests to. It is me if my leader is active, else the leader of the highest
+// ballot my acceptor adopted, unless its box is down
+func (rep *ReplicaAgent) leaderHint() c.ProcessID {
+	rep.lease.lmut.Lock()
+	active := rep.lease.ballot != nil
+	rep.lease.lmut.Unlock()
+	if active || rep.separated {
+		// With separated roles, any replica forwards requests to the leaders
+		return rep.myID
+	}
+	rep.acceptor.amut.RLock()
+	defer rep.acceptor.amut.RUnlock()
+	if rep.acceptor.ballotNum != nil && rep.failureDetector.isUp(rep.acceptor.ballotNum.id) {
+		return rep.acceptor.ballotNum.id
+	}
+	return rep.myID
 }
 
 // Start running leader thread described in Fig 7 of PMMC
 func (rep *ReplicaAgent) runLeader() {
-	preemptedInChan := make(chan ballot, bufferSize)          // channel into which scout/cmdr pushes preempted msg
-	adoptedInChan := make(chan map[uint64]pValue, bufferSize) // channel into which scout pushes adopted msg
+	preemptedInChan := make(chan ballot, bufferSize) // channel into which scout/cmdr pushes preempted msg
+	adoptedInChan := make(chan adoption, bufferSize) // channel into which scout pushes adopted msg
+	rep.persistLeaderBallot(rep.leader.ballotNum.n)
 	go rep.spawnScout(
 		rep.leader.ballotNum.n,
 		preemptedInChan,
-		adoptedInChan)
+		adoptedInChan,
+		rep.leader.stop)
+	holeTicker := time.NewTicker(holeTimeout)
+	defer holeTicker.Stop()
+	// Cancel the scout and commanders of my last ballot once I halt
+	defer func() { close(rep.leader.stop) }()
 	for rep.isActive {
 		rep.debugPrintf("Running Leader loop\n")
 		select {
 		case prop := <-rep.leader.proposeInChan:
 			rep.debugPrintf("Leader received proposal {slot: %d, client: %d, '%s'}\n", prop.slot, prop.req.clientID, prop.req.payload)
 			// Handle Propose
+			if prop.slot < rep.leader.floor {
+				// The slot is decided, and its pValues may be discarded
+				continue
+			}
 			if _, ok := rep.leader.proposals[prop.slot]; !ok {
 				// If slot not already used
 				rep.leader.proposals[prop.slot] = &prop
 				if rep.leader.active {
+					rep.leaseOnProposed(prop.slot)
 					cmdP2bOutChan := make(chan string, bufferSize)
 					rep.leader.p2bMut.Lock()
 					rep.leader.p2bOutChans[prop.slot] = cmdP2bOutChan
 					rep.leader.p2bMut.Unlock()
 					pval := &pValue{rep.leader.ballotNum.copy(), prop.slot, prop.req}
-					go rep.spawnCommander(pval, preemptedInChan, cmdP2bOutChan)
+					go rep.spawnCommander(pval, preemptedInChan, cmdP2bOutChan, rep.leader.stop)
 				}
 			}
-		case pmax := <-adoptedInChan:
+		case adopted := <-adoptedInChan:
 			// Handle Adopted
 			// pmax is a map of slot->pValue with highest ballot accepted
+			pmax := adopted.pmax
+			if adopted.floor > rep.leader.floor {
+				rep.leader.floor = adopted.floor
+			}
 			rep.debugPrintf("Leader adopted with ballot {%d, %d}\n", rep.leader.ballotNum.id, rep.leader.ballotNum.n)
 			for slot, highestAcceptedPVal := range pmax {
 				if _, ok := rep.leader.proposals[slot]; ok {
@@ -71,7 +138,16 @@ func (rep *ReplicaAgent) runLeader() {
 					rep.leader.proposals[slot] = prop
 				}
 			}
+			// Slots below the floor are decided, so they need no commander
+			rep.pruneProposals()
 			// Spawn commanders for each pval
+			maxSlot := uint64(0)
+			for slot := range rep.leader.proposals {
+				if slot+1 > maxSlot {
+					maxSlot = slot + 1
+				}
+			}
+			rep.leaseOnAdopted(rep.leader.ballotNum, maxSlot)
 			for _, prop := range rep.leader.proposals {
 				rep.dmut.RLock()
 				_, decided := rep.decisions[prop.slot]
@@ -83,65 +159,96 @@ func (rep *ReplicaAgent) runLeader() {
 					rep.leader.p2bOutChans[prop.slot] = cmdP2bOutChan
 					rep.leader.p2bMut.Unlock()
 					pval := &pValue{rep.leader.ballotNum.copy(), prop.slot, prop.req}
-					go rep.spawnCommander(pval, preemptedInChan, cmdP2bOutChan)
+					go rep.spawnCommander(pval, preemptedInChan, cmdP2bOutChan, rep.leader.stop)
 				}
 			}
 			rep.leader.active = true
+		case <-holeTicker.C:
+			// Handle decided and abandoned slots
+			rep.pruneProposals()
+			if rep.leader.active {
+				rep.fillHoles(preemptedInChan)
+			}
 		case bal := <-preemptedInChan:
 			// Handle Pre-empted
 			rep.debugPrintf("Leader {%d, %d} preempted with ballot {%d, %d}\n", rep.leader.ballotNum.id, rep.leader.ballotNum.n, bal.id, bal.n)
 
 			// Update my ballot number and spawn scout
 			if rep.leader.ballotNum.lt(&bal) {
+				// Cancel the scout or commanders of my old ballot
+				close(rep.leader.stop)
+				rep.leader.stop = make(chan struct{})
 				rep.leader.active = false
+				rep.leaseOnPreempted()
 				rep.leader.ballotNum.n = bal.n + 1
 			}
 			rep.debugPrintf("New ballot {%d, %d}\n", rep.leader.ballotNum.id, rep.leader.ballotNum.n)
 			time.Sleep(timeoutDuration * 10)
-			preemptedInChan = make(chan ballot, bufferSize)          // channel into which scout/cmdr pushes preempted msg
-			adoptedInChan = make(chan map[uint64]pValue, bufferSize) // channel into which scout pushes adopted msg
+			preemptedInChan = make(chan ballot, bufferSize) // channel into which scout/cmdr pushes preempted msg
+			adoptedInChan = make(chan adoption, bufferSize) // channel into which scout pushes adopted msg
+			rep.persistLeaderBallot(rep.leader.ballotNum.n)
 			go rep.spawnScout(
 				rep.leader.ballotNum.n,
 				preemptedInChan,
-				adoptedInChan)
+				adoptedInChan,
+				rep.leader.stop)
 		}
 	}
 }
 
 // Scout process in Fig 6 of PMMC
+// The scout returns once its ballot is adopted or preempted, or once stop is closed
 func (rep *ReplicaAgent) spawnScout(
 	baln uint64,
 	preemptedOutChan chan ballot, // channel into which scout pushes preempted msg
-	adoptedOutChan chan map[uint64]pValue) { // channel into which scout pushes adopted msg
+	adoptedOutChan chan adoption, // channel into which scout pushes adopted msg
+	stop chan struct{}) {
 
 	rep.debugPrintf("Scout spawned for ballot{%d, %d}\n", rep.myID, baln)
-	rep.leader.p1bOutChan = make(chan string, bufferSize)
+	p1bInChan := make(chan string, bufferSize)
+	rep.leader.p2bMut.Lock()
+	rep.leader.p1bOutChan = p1bInChan
 	rep.leader.p2bOutChans = make(map[uint64]chan string) // start a new set of channels
-	p1bInChan := rep.leader.p1bOutChan
-	waitfor := make(map[c.ProcessID]bool) // set of acceptors from which p1b is pending
-	wfmut := new(sync.RWMutex)
+	rep.leader.p2bMut.Unlock()
+	acks := make(map[c.ProcessID]bool) // set of acceptors that adopted myBallot
+	amut := new(sync.Mutex)            // mutex for acks
 	myBallot := &ballot{rep.myID, baln}
 	processedPVals := make(map[uint64]pValue)
+	acceptors := rep.currentConfig()
+	done := make(chan struct{}) // closed when the scout returns
+	defer close(done)
 
 	go func() {
 		for rep.isActive {
-			for acc := range rep.replicas {
-				// Send "p1a <sender> <balNum>"
-				wfmut.Lock()
-				waitfor[acc] = true
-				wfmut.Unlock()
-				// go func(acceptor c.ProcessID) {
-				p1a := fmt.Sprintf("p1a %d %d", myBallot.id, myBallot.n)
+			for _, acc := range pendingAcceptors(acceptors, acks, amut) {
+				// Send "p1a <sender> <balNum> <checkpoint>", where all slots below
+				// checkpoint are decided, so their pValues are not needed
+				p1a := fmt.Sprintf("p1a %d %d %d", myBallot.id, myBallot.n, rep.getSlotOut())
 				rep.send(acc, p1a)
-				// }(acc)
 			}
-			time.Sleep(timeoutDuration * 5)
+			select {
+			case <-done:
+				return
+			case <-stop:
+				return
+			case <-time.After(timeoutDuration * 5):
+			}
 		}
 	}()
+	floor := rep.getSlotOut() // slots my replica executed are decided
 	for rep.isActive {
-		payload := <-p1bInChan
-		acc, ballot, pVals := parseP1bPayload(payload)
+		var payload string
+		select {
+		case payload = <-p1bInChan:
+		case <-stop:
+			rep.debugPrintf("Scout {%d, %d} cancelled\n", rep.myID, baln)
+			return
+		}
+		acc, ballot, stable, pVals := parseP1bPayload(payload)
 		if myBallot.eq(ballot) {
+			if stable > floor {
+				floor = stable
+			}
 			// Adopted :) Now merge pValues from acceptor. For each p in pVals
 			// 1. If p.slot not in rprocessedPVals then processedPVals[p.slot] = p
 			// 2. Else, if processedPVals[p.slot].ballot.lt(p.ballot) then
@@ -156,93 +263,210 @@ func (rep *ReplicaAgent) spawnScout(
 				}
 			}
 			// Mark acc as responded
-			wfmut.Lock()
-			delete(waitfor, acc)
-			l := len(waitfor)
-			wfmut.Unlock()
-			if l <= int(math.Floor(float64(len(rep.replicas))/2.0)) {
-				adoptedOutChan <- processedPVals
-				rep.debugPrintf("Scout {%d, %d} ADOPTED\n", rep.myID, baln)
+			amut.Lock()
+			acks[acc] = true
+			adopted := rep.quorums.isPhase1Quorum(acks, acceptors)
+			amut.Unlock()
+			if adopted {
+				select {
+				case adoptedOutChan <- adoption{processedPVals, floor}:
+					rep.debugPrintf("Scout {%d, %d} ADOPTED\n", rep.myID, baln)
+				case <-stop:
+				}
 				return
 			}
 		} else {
 			// Pre-empted :(
-			preemptedOutChan <- *ballot
-			rep.debugPrintf("Scout {%d, %d} PREEMPTED\n", rep.myID, baln)
+			select {
+			case preemptedOutChan <- *ballot:
+				rep.debugPrintf("Scout {%d, %d} PREEMPTED\n", rep.myID, baln)
+			case <-stop:
+			}
 			return
 		}
 	}
 }
 
 // Commander process in Fig 6 of PMMC
+// The commander returns once pval is chosen, or once it or its leader is preempted
+// and stop is closed
 func (rep *ReplicaAgent) spawnCommander(
 	pval *pValue,
 	preemptedOutChan chan ballot,
-	p2bInChan chan string) {
+	p2bInChan chan string,
+	stop chan struct{}) {
 
 	rep.debugPrintf("Commander spawned for pval = {%v, %d, '%s'}\n", *pval.ballot, pval.slot, pval.req.payload)
 
-	waitfor := make(map[c.ProcessID]bool) // set of acceptors from which p2b is pending
-	wfmut := new(sync.RWMutex)
+	acks := make(map[c.ProcessID]bool) // set of acceptors that accepted pval
+	amut := new(sync.Mutex)            // mutex for acks
 	myBallot := pval.ballot
+	acceptors := rep.configAt(pval.slot) // acceptors of this slot
+	learners := rep.replicasAt(pval.slot)
+	done := make(chan struct{}) // closed when the commander returns
+	defer close(done)
+	defer rep.removeP2bOutChan(pval.slot, p2bInChan)
 
 	go func() {
 		for rep.isActive {
-			for acc := range rep.replicas {
-				// Send "p2a <balID> <balNum> <slot> <clientID> <reqNum> <m>"
-				wfmut.Lock()
-				waitfor[acc] = true
-				wfmut.Unlock()
-				// go func(acceptor c.ProcessID) {
-				p2a := fmt.Sprintf("p2a %d %d %d %d %d %s",
+			for _, acc := range pendingAcceptors(acceptors, acks, amut) {
+				// Send "p2a <balID> <balNum> <slot> <clientID> <epoch> <reqNum> <m>"
+				p2a := fmt.Sprintf("p2a %d %d %d %s",
 					myBallot.id,
 					myBallot.n,
 					pval.slot,
-					pval.req.clientID,
-					pval.req.reqNum,
-					pval.req.payload)
+					pval.req)
 				rep.send(acc, p2a)
-				// rep.debugPrintf("Commander sent {%v, %d, '%s'} sent p2a to %d\n", *pval.ballot, pval.slot, pval.req.payload, acc)
-				// }(acc)
 			}
-			time.Sleep(timeoutDuration * 5)
+			select {
+			case <-done:
+				return
+			case <-stop:
+				return
+			case <-time.After(timeoutDuration * 5):
+			}
 		}
 	}()
 	rep.debugPrintf("Commander {%v, %d, '%s'} sent p2a to all\n", *pval.ballot, pval.slot, pval.req.payload)
 	for rep.isActive {
-		payload := <-p2bInChan
+		var payload string
+		select {
+		case payload = <-p2bInChan:
+		case <-stop:
+			rep.debugPrintf("Commander {%v, %d, '%s'} cancelled\n", *pval.ballot, pval.slot, pval.req.payload)
+			return
+		}
 		acc, _, ballot := parseP2bPayload(payload)
 		if myBallot.eq(ballot) {
 			// Accepted :)
-			wfmut.Lock()
-			delete(waitfor, acc)
-			l := len(waitfor)
-			wfmut.Unlock()
-			if l <= int(math.Floor(float64(len(rep.replicas))/2.0)) {
-				// pVal is chosen. Broadcast "decision <slot> <clientID> <reqNum> <m>"
+			amut.Lock()
+			acks[acc] = true
+			chosen := rep.quorums.isPhase2Quorum(acks, acceptors)
+			amut.Unlock()
+			if chosen {
+				// pVal is chosen. Broadcast
+				// "decision <balID> <balNum> <slot> <clientID> <epoch> <reqNum> <m>"
 				rep.debugPrintf("Commander {%v, %d, '%s'} won. Broadcast decision\n", *pval.ballot, pval.slot, pval.req.payload)
-				msg := fmt.Sprintf("decision %d %d %d %s",
-					pval.slot,
-					pval.req.clientID,
-					pval.req.reqNum,
-					pval.req.payload)
-				for learner := range rep.replicas {
+				msg := fmt.Sprintf("decision %s", pval)
+				for learner := range learners {
 					rep.send(learner, msg)
 				}
 				return
 			}
 		} else {
 			// Pre-empted :(
-			preemptedOutChan <- *ballot
-			rep.debugPrintf("Commander for pval = {%v, %d, %s} preempted. No longer leader\n", pval.ballot, pval.slot, pval.req.payload)
+			select {
+			case preemptedOutChan <- *ballot:
+				rep.debugPrintf("Commander for pval = {%v, %d, %s} preempted. No longer leader\n", pval.ballot, pval.slot, pval.req.payload)
+			case <-stop:
+			}
 			return
 		}
 	}
 }
 
+// Returns the acceptors that have yet to answer, i.e. that are not in acks
+func pendingAcceptors(acceptors map[c.ProcessID]int, acks map[c.ProcessID]bool, amut *sync.Mutex) []c.ProcessID {
+	amut.Lock()
+	defer amut.Unlock()
+	pending := make([]c.ProcessID, 0, len(acceptors))
+	for acc := range acceptors {
+		if !acks[acc] {
+			pending = append(pending, acc)
+		}
+	}
+	return pending
+}
+
+// Removes the channel of the commander of slot from p2bOutChans, unless it has
+// already been replaced by the channel of a newer commander
+func (rep *ReplicaAgent) removeP2bOutChan(slot uint64, ch chan string) {
+	rep.leader.p2bMut.Lock()
+	defer rep.leader.p2bMut.Unlock()
+	if rep.leader.p2bOutChans[slot] == ch {
+		delete(rep.leader.p2bOutChans, slot)
+	}
+}
+
+// Forgets the proposals of the slots that every replica has executed. Must only
+// be called by the leader thread
+func (rep *ReplicaAgent) pruneProposals() {
+	if stable := rep.stableSlot(); stable > rep.leader.floor {
+		rep.leader.floor = stable
+	}
+	for slot := range rep.leader.proposals {
+		if slot < rep.leader.floor {
+			delete(rep.leader.proposals, slot)
+		}
+	}
+}
+
+// Proposes a no-op for every slot between the floor and my highest proposal that
+// had no proposal at the last check either. Such a slot was abandoned, e.g. by a
+// replica that crashed or skipped it, and stalls every replica. Must only be called
+// by the leader thread while it is active
+func (rep *ReplicaAgent) fillHoles(preemptedInChan chan ballot) {
+	maxSlot := uint64(0)
+	for slot := range rep.leader.proposals {
+		if slot+1 > maxSlot {
+			maxSlot = slot + 1
+		}
+	}
+	holes := make(map[uint64]bool)
+	for s := rep.leader.floor; s < maxSlot; s++ {
+		if _, ok := rep.leader.proposals[s]; ok {
+			continue
+		}
+		rep.dmut.RLock()
+		_, decided := rep.decisions[s]
+		rep.dmut.RUnlock()
+		if decided {
+			continue
+		}
+		if !rep.leader.holes[s] {
+			// Give the replicas a chance to propose for s first
+			holes[s] = true
+			continue
+		}
+		rep.debugPrintf("Leader fills abandoned slot %d with a no-op\n", s)
+		prop := &proposal{s, noopRequest(s)}
+		rep.leader.proposals[s] = prop
+		rep.leaseOnProposed(s)
+		cmdP2bOutChan := make(chan string, bufferSize)
+		rep.leader.p2bMut.Lock()
+		rep.leader.p2bOutChans[s] = cmdP2bOutChan
+		rep.leader.p2bMut.Unlock()
+		pval := &pValue{rep.leader.ballotNum.copy(), s, prop.req}
+		go rep.spawnCommander(pval, preemptedInChan, cmdP2bOutChan, rep.leader.stop)
+	}
+	rep.leader.holes = holes
+}
+
+// Deliver msg "propose <slot> <clientID> <epoch> <reqNum> <m>" from a replica
+// to the leader thread
+func (rep *ReplicaAgent) handleProposal(s string) {
+	sSlice := strings.SplitN(s, " ", 3)
+	if len(sSlice) != 3 {
+		rep.fatalAgentErrorf("Received invalid proposal '%s'\n", s)
+		return
+	}
+	slot, err := strconv.ParseUint(sSlice[1], 10, 64)
+	req, ok := parseRequest(sSlice[2])
+	if err != nil || !ok {
+		rep.fatalAgentErrorf("Received invalid proposal '%s'\n", s)
+		return
+	}
+	rep.leader.proposeInChan <- proposal{slot, req}
+}
+
 // Deliver msg "p1b <accID> <ballotNum.id> <ballotNum.n> <json(accepted pvals)>"
 func (rep *ReplicaAgent) handleP1b(request string) {
-	rep.leader.p1bOutChan <- strings.SplitN(request, " ", 2)[1]
+	rep.leader.p2bMut.RLock()
+	c := rep.leader.p1bOutChan
+	rep.leader.p2bMut.RUnlock()
+	if c != nil {
+		c <- strings.SplitN(request, " ", 2)[1]
+	}
 }
 
 // Deliver msg "p2b <accID> <slot> <ballotNum.id> <ballotNum.n>" Forward it to the right
@@ -0,0 +1,299 @@
+package paxos
+
+// This file describes the read lease of a paxos leader, and how a replica uses it
+// to serve read-only client commands without going through a slot.
+// An active leader periodically asks the acceptors for a lease on its ballot.
+// An acceptor that grants a lease promises not to adopt a higher ballot of another
+// leader until the lease expires. Hence, while a quorum of acceptors holds the
+// lease, no other leader can get a value chosen, and the replica co-located with the
+// leaseholder can answer reads from its own state once it has executed every slot
+// its leader proposed.
+// With separated roles, a replica has no co-located leader. It instead asks the
+// leaders for a read index: the leaseholder answers with the slot below which every
+// decision lies, and the replica serves the read once it has executed that slot.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+const (
+	leaseDuration      = 2000 * time.Millisecond // lease length, as timed by acceptors
+	leaseRenewInterval = 500 * time.Millisecond
+	leaseDriftMargin   = 200 * time.Millisecond // bound on clock drift between boxes
+)
+
+type leaseState struct {
+	ballot  *ballot                         // ballot of the active leader, nil if not active
+	maxSlot uint64                          // highest slot proposed under ballot, plus 1
+	expiry  time.Time                       // lease is valid until expiry
+	nextSeq uint64                          // sequence number of next lease request
+	sentAt  map[uint64]time.Time            // seq -> time lease request seq was sent
+	grants  map[uint64]map[c.ProcessID]bool // seq -> acceptors that granted it
+	reads   []*request                      // reads waiting for the lease or for execution
+	lmut    *sync.Mutex                     // mutex for all the above
+
+	// Reads of a replica with separated roles
+	indexing map[uint64]*indexedRead // seq -> read waiting for read index seq
+	indexed  []*indexedRead          // reads waiting for execution up to their index
+}
+
+// an indexedRead is a read that waits for all slots below index to be executed
+type indexedRead struct {
+	req    *request
+	index  uint64
+	sentAt time.Time // time the read index was requested
+}
+
+// Constructor
+func newLeaseState() *leaseState {
+	return &leaseState{
+		sentAt: make(map[uint64]time.Time),
+		grants: make(map[uint64]map[c.ProcessID]bool),
+		reads:  make([]*request, 0),
+		lmut:   new(sync.Mutex),
+
+		indexing: make(map[uint64]*indexedRead),
+		indexed:  make([]*indexedRead, 0)}
+}
+
+// Called by the leader thread when it is adopted with ballot b
+func (rep *ReplicaAgent) leaseOnAdopted(b *ballot, maxSlot uint64) {
+	l := rep.lease
+	l.lmut.Lock()
+	l.ballot = b.copy()
+	l.maxSlot = maxSlot
+	l.expiry = time.Time{}
+	l.sentAt = make(map[uint64]time.Time)
+	l.grants = make(map[uint64]map[c.ProcessID]bool)
+	l.lmut.Unlock()
+}
+
+// Called by the leader thread when it proposes pValue for slot s
+func (rep *ReplicaAgent) leaseOnProposed(s uint64) {
+	l := rep.lease
+	l.lmut.Lock()
+	if s+1 > l.maxSlot {
+		l.maxSlot = s + 1
+	}
+	l.lmut.Unlock()
+}
+
+// Called by the leader thread when it is preempted
+func (rep *ReplicaAgent) leaseOnPreempted() {
+	l := rep.lease
+	l.lmut.Lock()
+	l.ballot = nil
+	l.expiry = time.Time{}
+	l.lmut.Unlock()
+}
+
+// Periodically sends "leasereq <balID> <balNum> <seq>" to the acceptors while
+// the leader is active
+func (rep *ReplicaAgent) runLeaseRenewer() {
+	for rep.isActive {
+		l := rep.lease
+		l.lmut.Lock()
+		if l.ballot != nil {
+			seq := l.nextSeq
+			l.nextSeq++
+			l.sentAt[seq] = time.Now()
+			l.grants[seq] = make(map[c.ProcessID]bool)
+			msg := fmt.Sprintf("leasereq %d %d %d", l.ballot.id, l.ballot.n, seq)
+			// forget requests that can no longer extend the lease
+			for s, sent := range l.sentAt {
+				if time.Since(sent) > leaseDuration {
+					delete(l.sentAt, s)
+					delete(l.grants, s)
+				}
+			}
+			l.lmut.Unlock()
+			for acc := range rep.currentConfig() {
+				rep.send(acc, msg)
+			}
+		} else {
+			l.lmut.Unlock()
+		}
+		time.Sleep(leaseRenewInterval)
+	}
+}
+
+// Handle msg "leaseok <accID> <balID> <balNum> <seq>"
+func (rep *ReplicaAgent) handleLeaseGrant(s string) {
+	sSlice := strings.SplitN(s, " ", 5)
+	accID, _ := strconv.ParseUint(sSlice[1], 10, 64)
+	bID, _ := strconv.ParseUint(sSlice[2], 10, 64)
+	bn, _ := strconv.ParseUint(sSlice[3], 10, 64)
+	seq, _ := strconv.ParseUint(sSlice[4], 10, 64)
+	b := &ballot{c.ProcessID(bID), bn}
+
+	l := rep.lease
+	l.lmut.Lock()
+	grants, ok := l.grants[seq]
+	if l.ballot == nil || !l.ballot.eq(b) || !ok {
+		// Stale grant
+		l.lmut.Unlock()
+		return
+	}
+	grants[c.ProcessID(accID)] = true
+	// Leases block phase 2 of other leaders, so they are granted by a phase-1
+	// quorum, which intersects every phase-2 quorum
+	if rep.quorums.isPhase1Quorum(grants, rep.currentConfig()) {
+		// The lease runs from the time the request was sent, which is before
+		// any acceptor started timing it
+		expiry := l.sentAt[seq].Add(leaseDuration - leaseDriftMargin)
+		if expiry.After(l.expiry) {
+			l.expiry = expiry
+		}
+	}
+	l.lmut.Unlock()
+	rep.serveReads()
+}
+
+// Handles an incoming read "read <clientID> <epoch> <reqNum> <m>". A read is only
+// served by the leaseholder. Others redirect the client to the leader they know of
+func (rep *ReplicaAgent) handleReadRequest(r string) {
+	req, ok := parseRequest(strings.SplitN(r, " ", 2)[1])
+	if !ok {
+		rep.debugPrintf("Ignoring malformed read '%s'\n", r)
+		return
+	}
+	if rep.separated {
+		rep.requestReadIndex(req)
+		return
+	}
+	l := rep.lease
+	l.lmut.Lock()
+	if l.ballot == nil {
+		l.lmut.Unlock()
+		if hint := rep.leaderHint(); hint != rep.myID {
+			rep.send(req.clientID, fmt.Sprintf("redirect %d %d %d %d",
+				req.clientID, req.epoch, req.reqNum, hint))
+		}
+		return
+	}
+	l.reads = append(l.reads, req)
+	l.lmut.Unlock()
+	rep.serveReads()
+}
+
+// Sends "readindex <myID> <seq>" to the leaders, for read req
+func (rep *ReplicaAgent) requestReadIndex(req *request) {
+	l := rep.lease
+	l.lmut.Lock()
+	seq := l.nextSeq
+	l.nextSeq++
+	l.indexing[seq] = &indexedRead{req: req, sentAt: time.Now()}
+	// forget reads that no leader answered. The client will retry them
+	for s, r := range l.indexing {
+		if time.Since(r.sentAt) > leaseDuration {
+			delete(l.indexing, s)
+		}
+	}
+	l.lmut.Unlock()
+	msg := fmt.Sprintf("readindex %d %d", rep.myID, seq)
+	for ldr := range rep.leaders {
+		rep.send(ldr, msg)
+	}
+}
+
+// Handle msg "readindex <replicaID> <seq>". If I hold a valid lease, answer with
+// "readindexok <seq> <index>", where every decision is in a slot below index
+func (rep *ReplicaAgent) handleReadIndexRequest(s string) {
+	sSlice := strings.SplitN(s, " ", 3)
+	repID, _ := strconv.ParseUint(sSlice[1], 10, 64)
+	seq, _ := strconv.ParseUint(sSlice[2], 10, 64)
+	l := rep.lease
+	l.lmut.Lock()
+	valid := l.ballot != nil && time.Now().Before(l.expiry)
+	index := l.maxSlot
+	l.lmut.Unlock()
+	if !valid {
+		return
+	}
+	if slotOut := rep.getSlotOut(); slotOut > index {
+		// Slots below the checkpoint of my scout were decided before I was adopted
+		index = slotOut
+	}
+	rep.send(c.ProcessID(repID), fmt.Sprintf("readindexok %d %d", seq, index))
+}
+
+// Handle msg "readindexok <seq> <index>"
+func (rep *ReplicaAgent) handleReadIndexGrant(s string) {
+	sSlice := strings.SplitN(s, " ", 3)
+	seq, _ := strconv.ParseUint(sSlice[1], 10, 64)
+	index, _ := strconv.ParseUint(sSlice[2], 10, 64)
+	l := rep.lease
+	l.lmut.Lock()
+	r, ok := l.indexing[seq]
+	if ok {
+		delete(l.indexing, seq)
+		r.index = index
+		l.indexed = append(l.indexed, r)
+	}
+	l.lmut.Unlock()
+	rep.serveReads()
+}
+
+// Answers all pending reads if the lease is valid and every slot proposed under
+// it has been executed, and all indexed reads whose index has been executed.
+// Reads are answered with
+// "readok <clientID> <epoch> <reqNum> <leaderHint> <len(chatLog)> [<last message>]"
+func (rep *ReplicaAgent) serveReads() {
+	slotOut := rep.getSlotOut()
+	l := rep.lease
+	l.lmut.Lock()
+	if len(l.indexed) > 0 {
+		ready := make([]*request, 0)
+		waiting := make([]*indexedRead, 0)
+		for _, r := range l.indexed {
+			if r.index <= slotOut {
+				ready = append(ready, r.req)
+			} else {
+				waiting = append(waiting, r)
+			}
+		}
+		l.indexed = waiting
+		l.lmut.Unlock()
+		rep.answerReads(ready)
+		l.lmut.Lock()
+	}
+	if len(l.reads) == 0 {
+		l.lmut.Unlock()
+		return
+	}
+	if l.ballot == nil {
+		// No longer leader. Drop the reads
+		l.reads = make([]*request, 0)
+		l.lmut.Unlock()
+		return
+	}
+	if !time.Now().Before(l.expiry) || slotOut < l.maxSlot {
+		l.lmut.Unlock()
+		return
+	}
+	reads := l.reads
+	l.reads = make([]*request, 0)
+	l.lmut.Unlock()
+	rep.answerReads(reads)
+}
+
+// Answers reads from my current state
+func (rep *ReplicaAgent) answerReads(reads []*request) {
+	rep.xmut.RLock()
+	result := fmt.Sprintf("%d", len(rep.chatLog))
+	if len(rep.chatLog) > 0 {
+		result = fmt.Sprintf("%s %s", result, rep.chatLog[len(rep.chatLog)-1])
+	}
+	rep.xmut.RUnlock()
+	for _, req := range reads {
+		rep.send(req.clientID, fmt.Sprintf("readok %d %d %d %d %s",
+			req.clientID, req.epoch, req.reqNum, rep.myID, result))
+		rep.debugPrintf("Served read (%d, %d) locally\n", req.clientID, req.reqNum)
+	}
+}
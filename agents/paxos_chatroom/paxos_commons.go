@@ -12,22 +12,64 @@ import (
 )
 
 const (
-	pingInterval    = 100 * time.Microsecond
 	sleepDuration   = 100 * time.Millisecond
 	timeoutDuration = 1000 * time.Millisecond
 	bufferSize      = 10000
 	commandInterval = 1000 * time.Millisecond
+	window          = 5 // WINDOW in PMMC: slots before a reconfig takes effect
+	reportInterval  = 1000 * time.Millisecond
+	catchUpInterval = 2000 * time.Millisecond // time a replica may stall before it catches up
+	catchUpBatch    = 100                     // max decisions sent in one catch-up message
+	holeTimeout     = 2000 * time.Millisecond // time a leader waits before filling a hole
+
+	defaultCheckpointInterval = 100 // slots between checkpoints, see checkpoint.go
+)
+
+// reconfigClientID is the reserved client ID of reconfiguration commands.
+// No client agent may be configured with this ID.
+const reconfigClientID c.ProcessID = 0
+
+// A client registers with the service to start a new epoch, so that its request
+// numbers never collide with those of its previous incarnations. A registration
+// is a request with the reserved registrationEpoch, whose reqNum is a random nonce
+// and whose result is the new epoch. Reconfigurations are always in reconfigEpoch.
+const (
+	registrationEpoch uint64 = 0
+	reconfigEpoch     uint64 = 1
 )
 
 var wg sync.WaitGroup
 
-// a request describes a client request
+// a request describes a client request. It is identified end to end by
+// (clientID, epoch, reqNum)
 type request struct {
 	clientID c.ProcessID
+	epoch    uint64
 	reqNum   uint64
 	payload  string
 }
 
+// Formats r as "<clientID> <epoch> <reqNum> <m>"
+func (r *request) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.clientID, r.epoch, r.reqNum, r.payload)
+}
+
+// Parse "<clientID> <epoch> <reqNum> <m>" into a request.
+// Returns ok = false if s is malformed
+func parseRequest(s string) (req *request, ok bool) {
+	sSlice := strings.SplitN(s, " ", 4)
+	if len(sSlice) != 4 {
+		return nil, false
+	}
+	cid, err1 := strconv.ParseUint(sSlice[0], 10, 16)
+	epoch, err2 := strconv.ParseUint(sSlice[1], 10, 64)
+	rn, err3 := strconv.ParseUint(sSlice[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, false
+	}
+	return &request{c.ProcessID(cid), epoch, rn, sSlice[3]}, true
+}
+
 func (r *request) hash() string {
 	return fmt.Sprintf("%v", *r)
 }
@@ -36,6 +78,51 @@ func (r *request) eq(other *request) bool {
 	return r.hash() == other.hash()
 }
 
+// Returns true iff r and other are the same request of the same client, though
+// possibly with different payloads
+func (r *request) sameID(other *request) bool {
+	return r.clientID == other.clientID && r.epoch == other.epoch && r.reqNum == other.reqNum
+}
+
+// Returns true iff r is a reconfiguration command rather than a client request
+func (r *request) isReconfig() bool {
+	return r.clientID == reconfigClientID
+}
+
+// noopPayload is the payload of the no-op that a leader proposes to fill a slot
+// that no replica proposed a request for
+const noopPayload = "noop"
+
+// Returns the no-op for slot s. It has the reserved reconfigClientID, so it is
+// never confused with a client request
+func noopRequest(s uint64) *request {
+	return &request{reconfigClientID, reconfigEpoch, s, noopPayload}
+}
+
+// Returns true iff r is a no-op
+func (r *request) isNoop() bool {
+	return r.clientID == reconfigClientID && r.payload == noopPayload
+}
+
+// Returns true iff r is a client registration rather than a client request
+func (r *request) isRegistration() bool {
+	return r.epoch == registrationEpoch && !r.isReconfig()
+}
+
+// Parse the payload "<add|remove> <replicaID>" of a reconfiguration command.
+// Returns ok = false if the payload is malformed.
+func parseReconfigPayload(s string) (op string, id c.ProcessID, ok bool) {
+	sSlice := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	if len(sSlice) != 2 || (sSlice[0] != "add" && sSlice[0] != "remove") {
+		return "", 0, false
+	}
+	rid, err := strconv.ParseUint(sSlice[1], 10, 16)
+	if err != nil || c.ProcessID(rid) == reconfigClientID {
+		return "", 0, false
+	}
+	return sSlice[0], c.ProcessID(rid), true
+}
+
 // a proposal describes a (slot, request) pair
 type proposal struct {
 	slot uint64 // slot number
@@ -83,41 +170,63 @@ type pValue struct {
 	req    *request
 }
 
-// Parse "<sender> <balNum>" and return sender, balNum
-func parseP1aPayload(s string) (c.ProcessID, uint64) {
-	sSlice := strings.SplitN(s, " ", 2)
+// Parse "<sender> <balNum> [<checkpoint>]" and return sender, balNum, checkpoint.
+// The checkpoint is the slot below which the sender's replica has executed every
+// decision, and is 0 if absent.
+func parseP1aPayload(s string) (c.ProcessID, uint64, uint64) {
+	sSlice := strings.SplitN(s, " ", 3)
 	leaderID, _ := strconv.ParseUint(sSlice[0], 10, 64)
 	bNum, _ := strconv.ParseUint(sSlice[1], 10, 64)
-	return c.ProcessID(leaderID), bNum
+	var checkpoint uint64
+	if len(sSlice) == 3 {
+		checkpoint, _ = strconv.ParseUint(sSlice[2], 10, 64)
+	}
+	return c.ProcessID(leaderID), bNum, checkpoint
 }
 
-// Parse "<leaderID> <balNum> <slot> <clientID> <reqNum> <m>" into a pValue
+// Parse "<replicaID> <slotOut>" and return replicaID, slotOut
+func parseExecutedPayload(s string) (c.ProcessID, uint64) {
+	sSlice := strings.SplitN(s, " ", 2)
+	repID, _ := strconv.ParseUint(sSlice[0], 10, 64)
+	slotOut, _ := strconv.ParseUint(sSlice[1], 10, 64)
+	return c.ProcessID(repID), slotOut
+}
+
+// Formats p as "<leaderID> <balNum> <slot> <clientID> <epoch> <reqNum> <m>"
+func (p *pValue) String() string {
+	return fmt.Sprintf("%d %d %d %s", p.ballot.id, p.ballot.n, p.slot, p.req)
+}
+
+// Parse "<leaderID> <balNum> <slot> <clientID> <epoch> <reqNum> <m>" into a pValue.
+// The request of the pValue is nil if s is malformed
 func parsePValue(s string) *pValue {
-	sSlice := strings.SplitN(s, " ", 6)
+	sSlice := strings.SplitN(s, " ", 4)
+	if len(sSlice) != 4 {
+		return &pValue{&ballot{}, 0, nil}
+	}
 	leaderID, _ := strconv.ParseUint(sSlice[0], 10, 64)
 	bNum, _ := strconv.ParseUint(sSlice[1], 10, 64)
 	slot, _ := strconv.ParseUint(sSlice[2], 10, 64)
-	clientID, _ := strconv.ParseUint(sSlice[3], 10, 64)
-	reqNum, _ := strconv.ParseUint(sSlice[4], 10, 64)
-	m := sSlice[5]
+	req, _ := parseRequest(sSlice[3])
 	return &pValue{
 		&ballot{c.ProcessID(leaderID), bNum},
 		slot,
-		&request{c.ProcessID(clientID), reqNum, m}}
+		req}
 }
 
-// Parse "<accID> <ballotNum.id> <ballotNum.n> <json.Marshal(accepted)>"
-// into (accID, ballot, map of slot->pValue)
-func parseP1bPayload(s string) (c.ProcessID, *ballot, map[uint64]*pValue) {
-	sSlice := strings.SplitN(s, " ", 4)
+// Parse "<accID> <ballotNum.id> <ballotNum.n> <stable> <json.Marshal(accepted)>"
+// into (accID, ballot, stable, map of slot->pValue)
+func parseP1bPayload(s string) (c.ProcessID, *ballot, uint64, map[uint64]*pValue) {
+	sSlice := strings.SplitN(s, " ", 5)
 	accID, _ := strconv.ParseUint(sSlice[0], 10, 64)
 	bID, _ := strconv.ParseUint(sSlice[1], 10, 64)
 	bn, _ := strconv.ParseUint(sSlice[2], 10, 64)
+	stable, _ := strconv.ParseUint(sSlice[3], 10, 64)
 	pVals := make(map[uint64]*pValue)
 
 	// Parse and populate pVals
 	var dat map[string]interface{}
-	if err := json.Unmarshal([]byte(sSlice[3]), &dat); err != nil {
+	if err := json.Unmarshal([]byte(sSlice[4]), &dat); err != nil {
 		fmt.Println("HELP")
 		panic(err)
 	}
@@ -126,7 +235,7 @@ func parseP1bPayload(s string) (c.ProcessID, *ballot, map[uint64]*pValue) {
 		pVal := parsePValue(v.(string))
 		pVals[slot] = pVal
 	}
-	return c.ProcessID(accID), &ballot{c.ProcessID(bID), bn}, pVals
+	return c.ProcessID(accID), &ballot{c.ProcessID(bID), bn}, stable, pVals
 }
 
 // Parse "<accID> <slot> <ballotNum.id> <ballotNum.n>"
@@ -0,0 +1,199 @@
+package paxos
+
+// This file describes the quorum systems that a paxos replica may use for phase 1
+// (scouts, leases) and phase 2 (commanders) of the protocol.
+// As in Flexible Paxos, phase-1 quorums need only intersect phase-2 quorums, and
+// phase-2 quorums need not intersect each other. The quorum system is chosen by the
+// "quorums" attribute of a replica, e.g.
+//
+//	"quorums" : { "type" : "majority" }
+//	"quorums" : { "type" : "size", "q1" : 4, "q2" : 2 }
+//	"quorums" : { "type" : "grid", "columns" : 3 }
+//
+// All replicas of the service must be configured with the same quorum system.
+
+import (
+	"fmt"
+	"sort"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// quorumSystem decides whether a set of acceptors of a configuration forms a
+// phase-1 or a phase-2 quorum of that configuration
+type quorumSystem interface {
+	isPhase1Quorum(acks map[c.ProcessID]bool, config map[c.ProcessID]int) bool
+	isPhase2Quorum(acks map[c.ProcessID]bool, config map[c.ProcessID]int) bool
+	// Returns an error if the phase-1 and phase-2 quorums of config may not intersect
+	validate(config map[c.ProcessID]int) error
+	String() string
+}
+
+// Returns the number of acceptors in acks that are members of config
+func countAcks(acks map[c.ProcessID]bool, config map[c.ProcessID]int) int {
+	n := 0
+	for acc := range acks {
+		if _, ok := config[acc]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// majorityQuorums is the classic quorum system, where every quorum is a majority
+type majorityQuorums struct{}
+
+func (q majorityQuorums) isPhase1Quorum(acks map[c.ProcessID]bool, config map[c.ProcessID]int) bool {
+	return countAcks(acks, config) > len(config)/2
+}
+
+func (q majorityQuorums) isPhase2Quorum(acks map[c.ProcessID]bool, config map[c.ProcessID]int) bool {
+	return countAcks(acks, config) > len(config)/2
+}
+
+func (q majorityQuorums) validate(config map[c.ProcessID]int) error {
+	return nil
+}
+
+func (q majorityQuorums) String() string {
+	return "majority"
+}
+
+// sizeQuorums has phase-1 quorums of any q1 acceptors and phase-2 quorums of any
+// q2 acceptors. They intersect iff q1 + q2 > N
+type sizeQuorums struct {
+	q1, q2 int
+}
+
+func (q sizeQuorums) isPhase1Quorum(acks map[c.ProcessID]bool, config map[c.ProcessID]int) bool {
+	return countAcks(acks, config) >= q.q1
+}
+
+func (q sizeQuorums) isPhase2Quorum(acks map[c.ProcessID]bool, config map[c.ProcessID]int) bool {
+	return countAcks(acks, config) >= q.q2
+}
+
+func (q sizeQuorums) validate(config map[c.ProcessID]int) error {
+	n := len(config)
+	switch {
+	case q.q1 < 1 || q.q2 < 1:
+		return fmt.Errorf("quorum sizes must be positive")
+	case q.q1 > n || q.q2 > n:
+		return fmt.Errorf("quorum sizes exceed the %d acceptors", n)
+	case q.q1+q.q2 <= n:
+		return fmt.Errorf("q1 + q2 = %d must exceed the %d acceptors", q.q1+q.q2, n)
+	}
+	return nil
+}
+
+func (q sizeQuorums) String() string {
+	return fmt.Sprintf("size(q1=%d, q2=%d)", q.q1, q.q2)
+}
+
+// gridQuorums lays out the acceptors, sorted by ID, in rows of the given number of
+// columns. A phase-1 quorum is every acceptor of some row, and a phase-2 quorum is
+// some acceptor of every row
+type gridQuorums struct {
+	columns int
+}
+
+// Returns the rows of the grid of config
+func (q gridQuorums) rows(config map[c.ProcessID]int) [][]c.ProcessID {
+	ids := make([]int, 0, len(config))
+	for id := range config {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	rows := make([][]c.ProcessID, 0)
+	for i, id := range ids {
+		if i%q.columns == 0 {
+			rows = append(rows, make([]c.ProcessID, 0, q.columns))
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], c.ProcessID(id))
+	}
+	return rows
+}
+
+func (q gridQuorums) isPhase1Quorum(acks map[c.ProcessID]bool, config map[c.ProcessID]int) bool {
+	for _, row := range q.rows(config) {
+		full := true
+		for _, acc := range row {
+			if !acks[acc] {
+				full = false
+				break
+			}
+		}
+		if full {
+			return true
+		}
+	}
+	return false
+}
+
+func (q gridQuorums) isPhase2Quorum(acks map[c.ProcessID]bool, config map[c.ProcessID]int) bool {
+	for _, row := range q.rows(config) {
+		hit := false
+		for _, acc := range row {
+			if acks[acc] {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			return false
+		}
+	}
+	return true
+}
+
+func (q gridQuorums) validate(config map[c.ProcessID]int) error {
+	if q.columns < 1 {
+		return fmt.Errorf("grid must have at least one column")
+	}
+	return nil
+}
+
+func (q gridQuorums) String() string {
+	return fmt.Sprintf("grid(columns=%d)", q.columns)
+}
+
+// Returns the quorum system described by the "quorums" attribute attr, which may
+// be nil for majority quorums
+func parseQuorumSystem(attr interface{}) (quorumSystem, error) {
+	if attr == nil {
+		return majorityQuorums{}, nil
+	}
+	obj, ok := attr.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid quorums attribute %v", attr)
+	}
+	intField := func(k string) (int, error) {
+		v, ok := obj[k].(float64)
+		if !ok {
+			return 0, fmt.Errorf("quorums attribute needs numeric field '%s'", k)
+		}
+		return int(v), nil
+	}
+	switch obj["type"] {
+	case "majority":
+		return majorityQuorums{}, nil
+	case "size":
+		q1, err := intField("q1")
+		if err != nil {
+			return nil, err
+		}
+		q2, err := intField("q2")
+		if err != nil {
+			return nil, err
+		}
+		return sizeQuorums{q1, q2}, nil
+	case "grid":
+		cols, err := intField("columns")
+		if err != nil {
+			return nil, err
+		}
+		return gridQuorums{cols}, nil
+	default:
+		return nil, fmt.Errorf("unknown quorum system type %v", obj["type"])
+	}
+}
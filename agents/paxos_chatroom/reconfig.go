@@ -0,0 +1,108 @@
+package paxos
+
+// This file describes how a paxos replica reconfigures the set of replicas,
+// which double as the acceptors and leaders of the paxos service.
+// As in Section 3 of PMMC, a reconfiguration command is decided in some slot s
+// like any other request, and takes effect for slots s + window onwards.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Returns the replica set in effect for slot s, i.e. the configuration
+// with the greatest starting slot that is <= s
+func (rep *ReplicaAgent) configAt(s uint64) map[c.ProcessID]int {
+	rep.cmut.RLock()
+	defer rep.cmut.RUnlock()
+	var best uint64
+	for start := range rep.configs {
+		if start <= s && start >= best {
+			best = start
+		}
+	}
+	return rep.configs[best]
+}
+
+// Returns the replica set in effect for the next slot to be executed
+func (rep *ReplicaAgent) currentConfig() map[c.ProcessID]int {
+	return rep.configAt(rep.getSlotOut())
+}
+
+// Executes the reconfiguration command req decided in slot s. The new replica
+// set takes effect from slot s + window
+func (rep *ReplicaAgent) applyReconfig(s uint64, req *request) {
+	op, id, ok := parseReconfigPayload(req.payload)
+	if !ok {
+		rep.debugPrintf("Ignoring malformed reconfiguration '%s'\n", req.payload)
+		return
+	}
+	newConfig := make(map[c.ProcessID]int)
+	for r := range rep.configAt(s) {
+		newConfig[r] = 0
+	}
+	switch op {
+	case "add":
+		newConfig[id] = 0
+	case "remove":
+		delete(newConfig, id)
+	}
+	if len(newConfig) == 0 {
+		rep.debugPrintf("Ignoring reconfiguration '%s' that empties the replica set\n", req.payload)
+		return
+	}
+	if err := rep.quorums.validate(newConfig); err != nil {
+		// Every replica decides the same way, as they share the quorum system
+		rep.debugPrintf("Ignoring reconfiguration '%s': %v\n", req.payload, err)
+		return
+	}
+	rep.cmut.Lock()
+	rep.configs[s+window] = newConfig
+	rep.cmut.Unlock()
+	rep.debugPrintf("Replica set from slot %d is %v\n", s+window, configString(newConfig))
+}
+
+// Marks me as a leader iff I am in the replica set of my slotOut, as every replica
+// in the configuration acts as leader. A reconfiguration decided in slot s thus
+// changes the leaders once slot s + window is next to be executed
+func (rep *ReplicaAgent) updateLeadership() {
+	if rep.separated {
+		return
+	}
+	_, ok := rep.currentConfig()[rep.myID]
+	rep.failureDetector.setLeader(rep.myID, ok)
+}
+
+// Handles a controller command "reconfig <reqNum> <add|remove> <replicaID>" by
+// submitting it as a request to be decided
+func (rep *ReplicaAgent) handleReconfigCommand(r string) {
+	rSlice := strings.SplitN(r, " ", 3)
+	if len(rSlice) != 3 {
+		rep.debugPrintf("Ignoring malformed command '%s'\n", r)
+		return
+	}
+	rn, err := strconv.ParseUint(rSlice[1], 10, 64)
+	if _, _, ok := parseReconfigPayload(rSlice[2]); err != nil || !ok {
+		rep.debugPrintf("Ignoring malformed command '%s'\n", r)
+		return
+	}
+	if rep.separated {
+		rep.debugPrintf("Ignoring '%s', as the replica set of separated roles is static\n", r)
+		return
+	}
+	rep.submitRequest(&request{reconfigClientID, reconfigEpoch, rn, rSlice[2]})
+}
+
+// Returns a sorted, human readable list of the replicas in config
+func configString(config map[c.ProcessID]int) string {
+	ids := make([]int, 0, len(config))
+	for id := range config {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	return fmt.Sprintf("%v", ids)
+}
@@ -7,10 +7,10 @@ import (
 	"bufio"
 	"fmt"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	c "github.com/TonyZhangND/GoOvid/commons"
 )
@@ -24,28 +24,49 @@ type ReplicaAgent struct {
 	isActive         bool
 
 	// Replica attributes
-	myID      c.ProcessID
-	replicas  map[c.ProcessID]int
-	clients   map[c.ProcessID]int
-	mode      string         // script or manual modes
-	output    string         // path to output file for 'dump' command
-	skipSlots map[uint64]int // set containing slots to skip, see spec
+	myID          c.ProcessID
+	roles         int                 // roles of PMMC that I host, see roles.go
+	separated     bool                // true iff leaders and acceptors are not the replicas
+	replicas      map[c.ProcessID]int // initial replica set, see configs for the current one
+	leaders       map[c.ProcessID]int // leaders that replicas propose to, if separated
+	clients       map[c.ProcessID]int
+	mode          string      // script or manual modes
+	output        string      // path to output file for 'dump' command
+	controller    c.ProcessID // controller to report status to, if hasController
+	hasController bool
+	logPath       string         // path to durable acceptor log, "" if not durable
+	skipSlots     map[uint64]int // set containing slots to skip, see spec
+	quorums       quorumSystem   // phase-1 and phase-2 quorums, see quorum.go
 
 	// Replica state
 	chatLog   []string // application state
 	slotIn    uint64
-	slotOut   uint64
-	requests  map[string]*request  // given k->*v, k is a hash of v
-	proposals map[string]*proposal // given k->*v, k is a hash of v
-	decisions map[uint64]*request  // map of slot -> decision
+	slotOut   uint64                         // written under omut and dmut, see getSlotOut
+	requests  map[string]*request            // given k->*v, k is a hash of v
+	proposals map[string]*proposal           // given k->*v, k is a hash of v
+	decisions map[uint64]*request            // map of slot -> decision
+	slotInfo  map[uint64]*slotInfo           // map of slot -> ballot and status of decision
+	configs   map[uint64]map[c.ProcessID]int // map of starting slot -> acceptor set
+	sessions  *sessionTable                  // executed requests of each client
+
+	checkpoint         *snapshot // latest checkpoint, nil if none, see checkpoint.go
+	checkpointInterval uint64    // number of slots between checkpoints
+	executed           map[c.ProcessID]uint64
+	stable             uint64
 
 	rmut *sync.RWMutex // mutex for requests map
 	pmut *sync.RWMutex // mutex for proposals map
-	dmut *sync.RWMutex //mutex for decisions map
+	dmut *sync.RWMutex //mutex for decisions map, slotInfo and slotOut
+	cmut *sync.RWMutex // mutex for configs map
+	kmut *sync.RWMutex // mutex for checkpoint
+	emut *sync.RWMutex // mutex for executed map and stable
+	xmut *sync.RWMutex // mutex for chatLog
+	omut *sync.Mutex   // held while executing slots or installing a snapshot
 
-	failureDetector *unreliableFailureDetector // TODO: currently only used to mark leaders
+	failureDetector *unreliableFailureDetector // marks leaders, and the replicas that are down
 	acceptor        *acceptorState
 	leader          *leaderState
+	lease           *leaseState
 }
 
 // Init fills the empty kvs struct with this agent's fields and attributes.
@@ -53,6 +74,16 @@ func (rep *ReplicaAgent) Init(attrs map[string]interface{},
 	send func(vDest c.ProcessID, msg string),
 	fatalAgentErrorf func(errMsg string, a ...interface{}),
 	debugPrintf func(s string, a ...interface{})) {
+	rep.init(attrs, send, fatalAgentErrorf, debugPrintf, roleReplica)
+}
+
+// Initializes an agent of the given kind, which is roleReplica for a
+// paxos_replica, and the role of a standalone agent otherwise
+func (rep *ReplicaAgent) init(attrs map[string]interface{},
+	send func(vDest c.ProcessID, msg string),
+	fatalAgentErrorf func(errMsg string, a ...interface{}),
+	debugPrintf func(s string, a ...interface{}),
+	kind int) {
 	rep.send = send
 	rep.fatalAgentErrorf = fatalAgentErrorf
 	rep.debugPrintf = debugPrintf
@@ -60,17 +91,44 @@ func (rep *ReplicaAgent) Init(attrs map[string]interface{},
 
 	// Initialize replica attributes
 	rep.myID = c.ProcessID(attrs["myid"].(float64))
-	rep.replicas = make(map[c.ProcessID]int)
-	for _, x := range attrs["replicas"].([]interface{}) {
-		id := c.ProcessID(x.(float64))
-		rep.replicas[id] = 0
+	rep.replicas, _ = parseIDSet(attrs, "replicas")
+	rep.clients, _ = parseIDSet(attrs, "clients")
+	if rep.clients == nil {
+		rep.clients = make(map[c.ProcessID]int)
+	}
+	leaders, hasLeaders := parseIDSet(attrs, "leaders")
+	acceptors, hasAcceptors := parseIDSet(attrs, "acceptors")
+	rep.separated = kind != roleReplica || hasLeaders || hasAcceptors
+	if !hasLeaders {
+		leaders = rep.replicas
 	}
-	rep.clients = make(map[c.ProcessID]int)
-	for _, x := range attrs["clients"].([]interface{}) {
-		id := c.ProcessID(x.(float64))
-		rep.clients[id] = 0
+	if !hasAcceptors {
+		acceptors = rep.replicas
+	}
+	if kind == roleLeader && !hasAcceptors {
+		rep.fatalAgentErrorf("Leader needs an acceptors attribute\n")
+	}
+	rep.leaders = leaders
+	rep.roles = kind
+	if kind == roleReplica {
+		if _, ok := leaders[rep.myID]; ok {
+			rep.roles |= roleLeader
+		}
+		if _, ok := acceptors[rep.myID]; ok {
+			rep.roles |= roleAcceptor
+		}
+	}
+	if output, ok := attrs["output"].(string); ok {
+		rep.output = output
+	} else if kind == roleReplica {
+		rep.fatalAgentErrorf("Replica needs an output attribute\n")
+	}
+	if ctr, ok := attrs["controller"].(float64); ok {
+		rep.controller, rep.hasController = c.ProcessID(ctr), true
+	}
+	if logPath, ok := attrs["log"].(string); ok {
+		rep.logPath = logPath
 	}
-	rep.output = attrs["output"].(string)
 	rep.skipSlots = make(map[uint64]int)
 	if _, ok := attrs["skip"].([]interface{}); ok {
 		for _, x := range attrs["skip"].([]interface{}) {
@@ -79,6 +137,15 @@ func (rep *ReplicaAgent) Init(attrs map[string]interface{},
 		}
 	}
 	rep.debugPrintf("Skipping these slots : %v\n", rep.skipSlots)
+	quorums, err := parseQuorumSystem(attrs["quorums"])
+	if err == nil {
+		err = quorums.validate(acceptors)
+	}
+	if err != nil {
+		rep.fatalAgentErrorf("Invalid quorums attribute: %v\n", err)
+	}
+	rep.quorums = quorums
+	rep.debugPrintf("Using %v quorums\n", rep.quorums)
 
 	// Initialize replica state
 	rep.chatLog = make([]string, 0)
@@ -87,13 +154,27 @@ func (rep *ReplicaAgent) Init(attrs map[string]interface{},
 	rep.requests = make(map[string]*request)
 	rep.proposals = make(map[string]*proposal)
 	rep.decisions = make(map[uint64]*request)
+	rep.slotInfo = make(map[uint64]*slotInfo)
 	rep.rmut = new(sync.RWMutex) // mutex for requests map
 	rep.pmut = new(sync.RWMutex) // mutex for requests map
 	rep.dmut = new(sync.RWMutex) // mutex for requests map
+	rep.configs = map[uint64]map[c.ProcessID]int{0: acceptors}
+	rep.sessions = newSessionTable()
+	rep.checkpointInterval = defaultCheckpointInterval
+	if n, ok := attrs["checkpoint"].(float64); ok && n >= 1 {
+		rep.checkpointInterval = uint64(n)
+	}
+	rep.executed = make(map[c.ProcessID]uint64)
+	rep.kmut = new(sync.RWMutex)
+	rep.emut = new(sync.RWMutex)
+	rep.cmut = new(sync.RWMutex)
+	rep.xmut = new(sync.RWMutex)
+	rep.omut = new(sync.Mutex)
 	rep.acceptor = rep.newAcceptorState()
 	rep.leader = rep.newLeaderState()
+	rep.lease = newLeaseState()
 	rep.failureDetector = newUnreliableFailureDetector(rep)
-	for id := range rep.replicas {
+	for id := range rep.leaders {
 		// TODO: Just make everyone leaders for now
 		rep.failureDetector.leaders[id] = true
 	}
@@ -107,117 +188,108 @@ func (rep *ReplicaAgent) Halt() {
 // Run begins the execution of the paxos agent.
 func (rep *ReplicaAgent) Run() {
 	rep.isActive = true
-	rep.runLeader()
+	if rep.hosts(roleReplica) {
+		go rep.runExecutedReporter()
+		go rep.runCatchUp()
+	}
+	if rep.hosts(roleLeader) {
+		go rep.runLeaseRenewer()
+		rep.runLeader()
+	}
+}
+
+// Periodically reports my slotOut to the acceptors and leaders with
+// "executed <myID> <slotOut>", so that they can discard the pValues and proposals
+// of slots that every replica has executed
+func (rep *ReplicaAgent) runExecutedReporter() {
+	for rep.isActive {
+		msg := fmt.Sprintf("executed %d %d", rep.myID, rep.getSlotOut())
+		for acc := range rep.currentConfig() {
+			rep.send(acc, msg)
+		}
+		if rep.separated {
+			for ldr := range rep.leaders {
+				rep.send(ldr, msg)
+			}
+		}
+		time.Sleep(reportInterval)
+	}
 }
 
 // Deliver a message
 func (rep *ReplicaAgent) Deliver(request string, port c.PortNum) {
 	switch port {
 	case 1:
-		// Message from another replica
+		// Message from another replica, leader or acceptor
 		msgHeader := strings.SplitN(request, " ", 2)[0]
-		switch msgHeader {
-		case "decision":
+		switch {
+		case msgHeader == "decision" && rep.hosts(roleReplica):
 			rep.handleDecision(request)
-		case "p1a":
-			rep.handleP1a(request)
-		case "p2a":
-			rep.handleP2a(request)
-		case "p1b":
+		case msgHeader == "fetch" && rep.hosts(roleReplica):
+			rep.handleFetch(request)
+		case msgHeader == "decisions" && rep.hosts(roleReplica):
+			rep.handleDecisionBatch(request)
+		case msgHeader == "snapshot" && rep.hosts(roleReplica):
+			rep.handleSnapshot(request)
+		case msgHeader == "readindexok" && rep.hosts(roleReplica):
+			rep.handleReadIndexGrant(request)
+		case msgHeader == "propose" && rep.hosts(roleLeader):
+			rep.handleProposal(request)
+		case msgHeader == "p1b" && rep.hosts(roleLeader):
 			rep.handleP1b(request)
-		case "p2b":
+		case msgHeader == "p2b" && rep.hosts(roleLeader):
 			rep.handleP2b(request)
+		case msgHeader == "leaseok" && rep.hosts(roleLeader):
+			rep.handleLeaseGrant(request)
+		case msgHeader == "readindex" && rep.hosts(roleLeader):
+			rep.handleReadIndexRequest(request)
+		case msgHeader == "p1a" && rep.hosts(roleAcceptor):
+			rep.handleP1a(request)
+		case msgHeader == "p2a" && rep.hosts(roleAcceptor):
+			rep.handleP2a(request)
+		case msgHeader == "executed" && rep.hosts(roleLeader|roleAcceptor):
+			rep.handleExecuted(request)
+		case msgHeader == "leasereq" && rep.hosts(roleAcceptor):
+			rep.handleLeaseRequest(request)
 		default:
 			rep.fatalAgentErrorf("Received invalid msg '%s'\n", request)
 		}
 
 	case 2:
-		// Command from client, format "<clientID> <reqNum> <m>"
-		rep.handleClientRequest(request)
+		// Command from client, format "<clientID> <epoch> <reqNum> <m>", or
+		// "read <clientID> <epoch> <reqNum> <m>" for read-only commands
+		if !rep.hosts(roleReplica) {
+			rep.fatalAgentErrorf("Received client request '%s' without a replica\n", request)
+		}
+		if strings.HasPrefix(request, "read ") {
+			rep.handleReadRequest(request)
+		} else {
+			rep.handleClientRequest(request)
+		}
 	case 9:
 		// Command from controller
+		if !rep.hosts(roleReplica) {
+			rep.fatalAgentErrorf("Received controller command '%s' without a replica\n", request)
+		}
 		rep.handleControllerCommand(request)
 	default:
 		rep.fatalAgentErrorf("Received '%s' in unexpected port %v\n", request, port)
 	}
 }
 
-func (rep *ReplicaAgent) dumpPaxosLog() {
-	rep.debugPrintf("Handle dump\n")
-	f, err := os.Create(rep.output)
-	defer f.Close()
-	if err != nil {
-		rep.fatalAgentErrorf("Error creating file %s: %v\n", rep.output, err)
-	}
-	w := bufio.NewWriter(f)
-	if len(rep.decisions) == 0 {
-		return
-	}
-	keys := make([]int, len(rep.decisions))
-	i := 0
-	for k := range rep.decisions {
-		keys[i] = int(k)
-		i++
-	}
-	sort.Ints(keys)
-	maxSlotFilled := keys[len(keys)-1]
-	for i = 0; i <= maxSlotFilled; i++ {
-		if prop, ok := rep.decisions[uint64(i)]; ok {
-			_, err := w.WriteString(fmt.Sprintf("%d, %d, '%s'\n", prop.clientID, prop.reqNum, prop.payload))
-			if err != nil {
-				rep.fatalAgentErrorf("Error writing to file %s: %v\n", rep.output, err)
-			}
-		} else {
-			_, err := w.WriteString("hole\n")
-			if err != nil {
-				rep.fatalAgentErrorf("Error writing to file %s: %v\n", rep.output, err)
-			}
-		}
-	}
-	w.Flush()
-}
-
+// Dumps the chat log, i.e. the messages of the requests executed so far
 func (rep *ReplicaAgent) dumpChatLog() {
-	rep.debugPrintf("Handle dump the stupid way\n")
+	rep.debugPrintf("Handle dump\n")
 	f, err := os.Create(rep.output)
 	defer f.Close()
 	if err != nil {
 		rep.fatalAgentErrorf("Error creating file %s: %v\n", rep.output, err)
 	}
-	if len(rep.decisions) == 0 {
-		return
-	}
-	keys := make([]int, len(rep.decisions))
-	i := 0
-	for k := range rep.decisions {
-		keys[i] = int(k)
-		i++
-	}
-	sort.Ints(keys)
-	firstHole := len(keys) - 1
-	for i := 0; i < len(keys); i++ {
-		if keys[i] != i {
-			firstHole = i
-			break
-		}
-	}
-	rep.debugPrintf("First hole is %d\n", firstHole)
-
-	seen := make(map[string]bool)
-	chatLog := make([]string, 0)
-	rep.dmut.RLock()
-	for i := 0; i < firstHole; i++ {
-		s := uint64(keys[i])
-		if _, ok := seen[rep.decisions[s].hash()]; !ok {
-			log := fmt.Sprintf("%d, %d : '%s'\n", rep.decisions[s].clientID, rep.decisions[s].reqNum, rep.decisions[s].payload)
-			chatLog = append(chatLog, log)
-		}
-		seen[rep.decisions[s].hash()] = true
-	}
-	rep.dmut.RUnlock()
 	w := bufio.NewWriter(f)
-	for _, c := range chatLog {
-		_, err := w.WriteString(c)
+	rep.xmut.RLock()
+	defer rep.xmut.RUnlock()
+	for _, m := range rep.chatLog {
+		_, err := w.WriteString(m + "\n")
 		if err != nil {
 			rep.fatalAgentErrorf("Error writing to file %s: %v\n", rep.output, err)
 		}
@@ -230,26 +302,17 @@ func (rep *ReplicaAgent) handleControllerCommand(r string) {
 	switch cmd {
 	case "dump":
 		rep.dumpChatLog()
-		// rep.debugPrintf("Handle dump\n")
-		// // rep.debugPrintf("LOG %v\n", rep.chatLog)
-		// f, err := os.Create(rep.output)
-		// // rep.debugPrintf("HELLO1\n")
-		// defer f.Close()
-		// if err != nil {
-		// 	rep.fatalAgentErrorf("Error creating file %s: %v\n", rep.output, err)
-		// }
-		// w := bufio.NewWriter(f)
-		// // rep.debugPrintf("HELLO2 %d\n", len(rep.chatLog))
-		// for _, s := range rep.chatLog {
-		// 	rep.debugPrintf("%s\n", s)
-		// 	_, err = w.WriteString(fmt.Sprintf("%s\n", s))
-		// 	if err != nil {
-		// 		rep.fatalAgentErrorf("Error writing to file %s: %v\n", rep.output, err)
-		// 	}
-		// }
-		// // rep.debugPrintf("BOB\n")
-		// w.Flush()
-
+		rep.writeDump(rep.output + ".json")
+		if rep.hasController {
+			rep.send(rep.controller, fmt.Sprintf("dumped %d %s", rep.myID, rep.output+".json"))
+		}
+	case "status":
+		// Report "status replica <myID> <slotOut>", see script.go
+		if rep.hasController {
+			rep.send(rep.controller, fmt.Sprintf("status replica %d %d", rep.myID, rep.getSlotOut()))
+		}
+	case "reconfig":
+		rep.handleReconfigCommand(r)
 	case "kill":
 		// TODO
 	case "skip":
@@ -257,35 +320,52 @@ func (rep *ReplicaAgent) handleControllerCommand(r string) {
 	}
 }
 
-// Handles an incoming client request "<clientID> <reqNum> <m>"
+// Handles an incoming client request "<clientID> <epoch> <reqNum> <m>".
+// A request in the registration epoch registers the client for a new epoch
 func (rep *ReplicaAgent) handleClientRequest(r string) {
-	if _, ok := rep.failureDetector.leaders[rep.myID]; !ok {
-		// ignore request if I am not leader
+	req, ok := parseRequest(r)
+	if !ok {
+		rep.debugPrintf("Ignoring malformed request '%s'\n", r)
 		return
 	}
-	reqSlice := strings.SplitN(r, " ", 3)
-	cid, _ := strconv.ParseUint(reqSlice[0], 10, 64)
-	rn, _ := strconv.ParseUint(reqSlice[1], 10, 64)
-	m := reqSlice[2]
-	req := &request{c.ProcessID(cid), rn, m}
+	if req.clientID == reconfigClientID {
+		// Only the controller may issue reconfigurations
+		rep.debugPrintf("Ignoring request '%s' from reserved client ID\n", r)
+		return
+	}
+	rep.submitRequest(req)
+	if hint := rep.leaderHint(); hint != rep.myID {
+		// Point the client to the leader, as I may never get to propose req
+		rep.send(req.clientID, fmt.Sprintf("redirect %d %d %d %d",
+			req.clientID, req.epoch, req.reqNum, hint))
+	}
+}
 
-	// If request is already decided, return the decision
-	rep.dmut.RLock()
-	for _, decision := range rep.decisions {
-		if decision.eq(req) {
-			defer rep.dmut.RUnlock()
-			response := fmt.Sprintf("committed %d %d", req.clientID, req.reqNum)
-			rep.send(req.clientID, response)
-			return
+// Submits req to be decided, if it is not already decided or pending
+func (rep *ReplicaAgent) submitRequest(req *request) {
+	result, status := rep.sessions.status(req)
+	switch status {
+	case reqExecuted:
+		// If request is already executed, return the cached result
+		if !req.isReconfig() {
+			rep.sendCommitted(req, result)
 		}
+		return
+	case reqStale:
+		// The client has since registered again. Nobody is waiting for req
+		rep.debugPrintf("Ignoring stale request (%d, %d, %d)\n", req.clientID, req.epoch, req.reqNum)
+		return
+	}
+	if !rep.shouldPropose() {
+		// ignore request if I am not leader
+		return
 	}
-	rep.dmut.RUnlock()
 
 	// Add req to my handy dandy set of requests only if it is not repeated, and propose()
 	isOldReq := false
 	rep.rmut.RLock()
 	for _, myReq := range rep.requests {
-		if req.eq(myReq) {
+		if req.sameID(myReq) {
 			isOldReq = true
 		}
 	}
@@ -293,8 +373,15 @@ func (rep *ReplicaAgent) handleClientRequest(r string) {
 	rep.pmut.RLock()
 	if !isOldReq {
 		for _, p := range rep.proposals {
-			if req.eq(p.req) {
+			if req.sameID(p.req) {
 				isOldReq = true
+				if !rep.hosts(roleLeader) {
+					// The leaders may have missed my proposal. Propose it again
+					msg := fmt.Sprintf("propose %d %s", p.slot, p.req)
+					for ldr := range rep.leaders {
+						rep.send(ldr, msg)
+					}
+				}
 			}
 		}
 	}
@@ -309,8 +396,17 @@ func (rep *ReplicaAgent) handleClientRequest(r string) {
 
 // Propose method in Fig 1 of PMMC
 func (rep *ReplicaAgent) propose() {
+	slotOut := rep.getSlotOut()
 	rep.rmut.Lock()
+	if rep.slotIn < slotOut {
+		// Every slot below slotOut is decided, and may have been truncated
+		rep.slotIn = slotOut
+	}
 	for k, req := range rep.requests {
+		if rep.slotIn >= slotOut+window {
+			// The configuration of slots beyond the window is not yet known
+			break
+		}
 		// For each req in rep.requests, start proposing it for each slot
 		// that I have not proposed a value nor learned a decision
 		rep.dmut.RLock()
@@ -333,72 +429,147 @@ func (rep *ReplicaAgent) propose() {
 		rep.pmut.Lock()
 		rep.proposals[prop.hash()] = prop
 		rep.pmut.Unlock()
-		// Forward proposal to leader thread
-		rep.leader.proposeInChan <- *prop
+		// Forward proposal to leader thread, or to the leaders if I have none
+		if rep.hosts(roleLeader) {
+			rep.leader.proposeInChan <- *prop
+		} else {
+			msg := fmt.Sprintf("propose %d %s", prop.slot, prop.req)
+			for ldr := range rep.leaders {
+				rep.send(ldr, msg)
+			}
+		}
 		rep.slotIn++
 	}
 	rep.rmut.Unlock()
 }
 
-// Perform method in Fig 1 of PMMC
-func (rep *ReplicaAgent) perform(req *request) {
+// Perform method in Fig 1 of PMMC, for req decided in slot, my slotOut. Returns
+// the result to commit to the client of req, if any. Caller holds omut
+func (rep *ReplicaAgent) perform(slot uint64, req *request) (string, bool) {
 	rep.debugPrintf("performing %v\n", *req)
-	rep.dmut.RLock()
-	for s, oldDec := range rep.decisions {
-		// If req has been previously committed, ignore it
-		if rep.slotOut > s && oldDec.eq(req) {
-			rep.slotOut++
-			rep.dmut.RUnlock()
-			return
+	if req.isNoop() {
+		// A leader filled an abandoned slot
+		rep.executeSlot(slotNoop)
+		return "", false
+	}
+	if _, status := rep.sessions.status(req); status != reqNew {
+		// If req has been previously committed, or its epoch is not the
+		// current one of its client, ignore it
+		if status == reqExecuted {
+			rep.executeSlot(slotDuplicate)
+		} else {
+			rep.executeSlot(slotSkipped)
 		}
+		return "", false
 	}
-	rep.dmut.RUnlock()
-	// Else execute the request and perform output commit to client
-	// "committed <clientID> <reqNum>."
-	rep.chatLog = append(rep.chatLog, fmt.Sprintf("%d: %s", req.clientID, req.payload))
-	response := fmt.Sprintf("committed %d %d", req.clientID, req.reqNum)
-	rep.send(req.clientID, response)
-	rep.slotOut++
+	if req.isRegistration() {
+		// Registrations start a new session, and return its epoch
+		epoch := rep.sessions.register(req)
+		rep.executeSlot(slotRegistration)
+		rep.debugPrintf("Registered client %d for epoch %s\n", req.clientID, epoch)
+		return epoch, true
+	}
+	if req.isReconfig() {
+		// Reconfigurations change the replica set, not the application state
+		rep.applyReconfig(slot, req)
+		rep.sessions.record(req, "")
+		rep.executeSlot(slotReconfig)
+		return "", false
+	}
+	// Else execute the request and perform output commit to client.
+	// The result of a request is the index of its message in the chat log
+	rep.xmut.Lock()
+	rep.chatLog = append(rep.chatLog, fmt.Sprintf("%d, %d : '%s'", req.clientID, req.reqNum, req.payload))
+	result := strconv.Itoa(len(rep.chatLog) - 1)
+	rep.xmut.Unlock()
+	rep.sessions.record(req, result)
+	rep.executeSlot(slotExecuted)
 	rep.debugPrintf("Commited {%d, %d, %s}\n", req.clientID, req.reqNum, req.payload)
+	return result, true
+}
+
+// Sends "committed <clientID> <epoch> <reqNum> <leaderHint> <result>" to the
+// client of req
+func (rep *ReplicaAgent) sendCommitted(req *request, result string) {
+	response := fmt.Sprintf("committed %d %d %d %d %s",
+		req.clientID, req.epoch, req.reqNum, rep.leaderHint(), result)
+	rep.send(req.clientID, strings.TrimSpace(response))
 }
 
-// Handles a decision message "decision <slot> <clientID> <reqNum> <m>"
+// Handles a decision message
+// "decision <balID> <balNum> <slot> <clientID> <epoch> <reqNum> <m>", i.e. the
+// chosen pValue
 func (rep *ReplicaAgent) handleDecision(d string) {
 	// Store decision in rep.decisions
-	dSlice := strings.SplitN(d, " ", 5)
-	slot, _ := strconv.ParseUint(dSlice[1], 10, 64)
-	id, _ := strconv.ParseUint(dSlice[2], 10, 64)
-	cid := c.ProcessID(id) // client who issued the request
-	reqNum, _ := strconv.ParseUint(dSlice[3], 10, 64)
-	m := dSlice[4]
-	rep.debugPrintf("Received decision for %d : (%d, %d)\n", slot, cid, reqNum)
-	newDec := &request{cid, reqNum, m}
-
-	// ignore if decision already received
-	rep.dmut.RLock()
-	if _, ok := rep.decisions[slot]; ok {
-		rep.dmut.RUnlock()
+	pval := parsePValue(strings.SplitN(d, " ", 2)[1])
+	if pval.req == nil {
+		rep.fatalAgentErrorf("Received invalid decision '%s'\n", d)
 		return
 	}
-	rep.dmut.RUnlock()
+	rep.debugPrintf("Received decision for %d : (%d, %d)\n", pval.slot, pval.req.clientID, pval.req.reqNum)
+	if rep.learnDecision(pval) {
+		rep.executeDecisions()
+	}
+}
 
+// Stores the decision of chosen pValue pval. Returns false iff the decision was
+// already known
+func (rep *ReplicaAgent) learnDecision(pval *pValue) bool {
 	rep.dmut.Lock()
-	rep.decisions[slot] = newDec
-	rep.dmut.Unlock()
+	defer rep.dmut.Unlock()
+	if _, ok := rep.decisions[pval.slot]; ok || pval.slot < rep.slotOut {
+		// ignore if decision already received, or executed and truncated
+		return false
+	}
+	rep.decisions[pval.slot] = pval.req
+	rep.slotInfo[pval.slot] = &slotInfo{ballot: pval.ballot, status: slotPending}
+	return true
+}
+
+// Records the execution status of decided slot slotOut, and moves on to the next
+// slot. Caller holds omut
+func (rep *ReplicaAgent) executeSlot(status string) {
+	rep.dmut.Lock()
+	defer rep.dmut.Unlock()
+	if info, ok := rep.slotInfo[rep.slotOut]; ok {
+		info.status = status
+	}
+	rep.slotOut++
+}
 
-	// Execute all decisions that can be committed
+// Returns my slotOut, i.e. the next slot to be executed
+func (rep *ReplicaAgent) getSlotOut() uint64 {
 	rep.dmut.RLock()
-	decToExec, ok := rep.decisions[rep.slotOut]
-	rep.dmut.RUnlock()
-	for ok {
-		rep.debugPrintf("HEYHEY for %d : (%d, %d)\n", slot, cid, reqNum)
+	defer rep.dmut.RUnlock()
+	return rep.slotOut
+}
+
+// Executes all decisions that can be committed, in slot order. Each slot is
+// fetched, performed and passed under omut, so that it is executed once. The
+// results are committed to the clients once omut is released, as the clients
+// may answer within the send
+func (rep *ReplicaAgent) executeDecisions() {
+	type commit struct {
+		req    *request
+		result string
+	}
+	commits := make([]commit, 0)
+	rep.omut.Lock()
+	for {
+		rep.dmut.RLock()
+		slot := rep.slotOut
+		decToExec, ok := rep.decisions[slot]
+		rep.dmut.RUnlock()
+		if !ok {
+			break
+		}
 		// If slot of request I am about to excute is used in proposals, then
 		// 1. remove it from proposals, and
 		// 2. if the req removed is not the one I am about to execute, put it back
 		//    into rep.requests
 		rep.pmut.Lock()
 		for k, prop := range rep.proposals {
-			if prop.slot == rep.slotOut {
+			if prop.slot == slot {
 				// If slotOut used for a command in rep.proposals
 				delete(rep.proposals, k)
 				if !prop.req.eq(decToExec) {
@@ -411,12 +582,20 @@ func (rep *ReplicaAgent) handleDecision(d string) {
 			}
 		}
 		rep.pmut.Unlock()
-		rep.perform(decToExec)
-		rep.dmut.RLock()
-		decToExec, ok = rep.decisions[rep.slotOut]
-		rep.dmut.RUnlock()
+		if result, ok := rep.perform(slot, decToExec); ok {
+			commits = append(commits, commit{decToExec, result})
+		}
+		rep.updateLeadership()
+	}
+	if rep.getSlotOut() >= rep.checkpointSlot()+rep.checkpointInterval {
+		rep.takeCheckpoint()
+	}
+	rep.omut.Unlock()
+	for _, cm := range commits {
+		rep.sendCommitted(cm.req, cm.result)
 	}
-	if _, ok := rep.failureDetector.leaders[rep.myID]; ok {
+	rep.serveReads()
+	if rep.shouldPropose() {
 		// propose() iff I am leader
 		rep.propose()
 	}
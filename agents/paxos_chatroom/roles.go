@@ -0,0 +1,89 @@
+package paxos
+
+// This file describes the roles of PMMC that a paxos agent may host, and the
+// standalone agent types that host a single role.
+// By default, every paxos_replica hosts a replica, a leader and an acceptor, and
+// the replica set doubles as the set of leaders and of acceptors. If a
+// paxos_replica has a "leaders" or an "acceptors" attribute, the roles are
+// separated: the replica only hosts the leader (acceptor) role if its ID is listed
+// in "leaders" ("acceptors"), and the other roles are played by paxos_leader and
+// paxos_acceptor agents, e.g. to run 2f+1 acceptors with f+1 replicas.
+// Roles communicate over port 1, with routes from each agent to every agent it
+// talks to: replicas to leaders (and to leaders for reads) and acceptors, leaders
+// to acceptors and replicas, acceptors to leaders. The replica set of a deployment
+// with separated roles is static.
+
+import (
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Roles of PMMC hosted by a paxos agent
+const (
+	roleReplica = 1 << iota
+	roleLeader
+	roleAcceptor
+)
+
+// LeaderAgent is a standalone paxos leader. Its attributes are
+// "myid", "replicas", "acceptors" and optionally "quorums" and "log", a file that
+// keeps the ballots of the leader across restarts
+type LeaderAgent struct {
+	ReplicaAgent
+}
+
+// Init fills the empty leader struct with this agent's fields and attributes.
+func (ldr *LeaderAgent) Init(attrs map[string]interface{},
+	send func(vDest c.ProcessID, msg string),
+	fatalAgentErrorf func(errMsg string, a ...interface{}),
+	debugPrintf func(s string, a ...interface{})) {
+	ldr.init(attrs, send, fatalAgentErrorf, debugPrintf, roleLeader)
+}
+
+// AcceptorAgent is a standalone paxos acceptor. Its attributes are
+// "myid", "replicas", and optionally "log"
+type AcceptorAgent struct {
+	ReplicaAgent
+}
+
+// Init fills the empty acceptor struct with this agent's fields and attributes.
+func (acc *AcceptorAgent) Init(attrs map[string]interface{},
+	send func(vDest c.ProcessID, msg string),
+	fatalAgentErrorf func(errMsg string, a ...interface{}),
+	debugPrintf func(s string, a ...interface{})) {
+	acc.init(attrs, send, fatalAgentErrorf, debugPrintf, roleAcceptor)
+}
+
+// Returns true iff I host role
+func (rep *ReplicaAgent) hosts(role int) bool {
+	return rep.roles&role != 0
+}
+
+// Returns the set of replicas that learn and execute slot s
+func (rep *ReplicaAgent) replicasAt(s uint64) map[c.ProcessID]int {
+	if rep.separated {
+		return rep.replicas
+	}
+	return rep.configAt(s)
+}
+
+// Returns true iff my replica proposes the requests it receives, i.e. if it has no
+// co-located leader, or its co-located leader is in the current configuration
+func (rep *ReplicaAgent) shouldPropose() bool {
+	if !rep.hosts(roleLeader) {
+		return true
+	}
+	return rep.failureDetector.isLeader(rep.myID)
+}
+
+// Returns the set of IDs in the attribute attrs[key], and whether it is present
+func parseIDSet(attrs map[string]interface{}, key string) (map[c.ProcessID]int, bool) {
+	ids, ok := attrs[key].([]interface{})
+	if !ok {
+		return nil, false
+	}
+	set := make(map[c.ProcessID]int)
+	for _, x := range ids {
+		set[c.ProcessID(x.(float64))] = 0
+	}
+	return set, true
+}
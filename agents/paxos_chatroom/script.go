@@ -0,0 +1,324 @@
+package paxos
+
+// This file describes the scenarios that a controller may run instead of reading
+// commands from stdin, so that fault scenarios become repeatable tests.
+// A scenario is given by the "script" attribute of the controller. It is a file of
+// controller commands, one per line, where empty lines and lines starting with '#'
+// are ignored. Besides the interactive commands, a scenario may use
+//
+//	sleep <duration>              e.g. "sleep 500ms"
+//	await <condition> [<timeout>] wait until condition holds, default timeout 10s
+//	assert <condition>            fail unless condition holds now
+//
+// where condition is one of
+//
+//	commits <clientID> <n>        the client has had at least n writes committed
+//	executed <replicaID|all> <n>  the replica (every replica) executed the slots below n
+//	converged                     the replicas that answer executed the same slots
+//	consistent [<outstanding>]    the structured dumps of the replicas that answer
+//	                              pass CheckDumps, for clients with at most
+//	                              outstanding requests in flight (default 1)
+//
+// Conditions are evaluated on the status that clients and replicas report when the
+// controller asks them, which they do if they have a "controller" attribute and a
+// route to it. The controller exits with status 0 once the scenario completes, and
+// with status 1 at the first command that fails. Either way, it first kills the
+// boxes that the scenario started and did not kill.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// errExit is returned by runScriptCommand at an "exit" command
+var errExit = errors.New("exit")
+
+const (
+	defaultAwaitTimeout = 10 * time.Second
+	statusPollInterval  = 200 * time.Millisecond // interval between status requests of await
+	statusWait          = 500 * time.Millisecond // time for agents to answer a status request
+)
+
+// reports holds the latest status reported by clients and replicas
+type reports struct {
+	commits  map[c.ProcessID]uint64 // clientID -> number of writes committed
+	slotOuts map[c.ProcessID]uint64 // replicaID -> slotOut
+	dumps    map[c.ProcessID]string // replicaID -> path of its latest structured dump
+	rmut     *sync.Mutex            // mutex for all the above
+}
+
+// Constructor
+func newReports() *reports {
+	return &reports{
+		commits:  make(map[c.ProcessID]uint64),
+		slotOuts: make(map[c.ProcessID]uint64),
+		dumps:    make(map[c.ProcessID]string),
+		rmut:     new(sync.Mutex)}
+}
+
+// Handles a report "status client <clientID> <commits>",
+// "status replica <replicaID> <slotOut>" or "dumped <replicaID> <path>"
+func (r *reports) handleReport(s string) {
+	sSlice := strings.Fields(s)
+	r.rmut.Lock()
+	defer r.rmut.Unlock()
+	switch {
+	case len(sSlice) == 4 && sSlice[0] == "status":
+		id, err1 := strconv.ParseUint(sSlice[2], 10, 16)
+		n, err2 := strconv.ParseUint(sSlice[3], 10, 64)
+		if err1 != nil || err2 != nil {
+			return
+		}
+		if sSlice[1] == "client" {
+			r.commits[c.ProcessID(id)] = n
+		} else if sSlice[1] == "replica" {
+			r.slotOuts[c.ProcessID(id)] = n
+		}
+	case len(sSlice) == 3 && sSlice[0] == "dumped":
+		id, err := strconv.ParseUint(sSlice[1], 10, 16)
+		if err == nil {
+			r.dumps[c.ProcessID(id)] = sSlice[2]
+		}
+	}
+}
+
+// Forgets the reported dumps, before new ones are requested
+func (r *reports) clearDumps() {
+	r.rmut.Lock()
+	r.dumps = make(map[c.ProcessID]string)
+	r.rmut.Unlock()
+}
+
+// Returns the lines of the scenario at path
+func readScript(path string, fatalAgentErrorf func(errMsg string, a ...interface{})) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		fatalAgentErrorf("Cannot open script %s: %v\n", path, err)
+		return nil
+	}
+	defer f.Close()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		fatalAgentErrorf("Cannot read script %s: %v\n", path, err)
+	}
+	return lines
+}
+
+// Runs my scenario, and exits with its status
+func (ctr *ControllerAgent) runScript() {
+	fmt.Println("Paxos controller active. Running script")
+	for i, line := range ctr.script {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fmt.Printf("> %s\n", line)
+		err := ctr.runScriptCommand(line)
+		if err == errExit {
+			break
+		}
+		if err != nil {
+			fmt.Printf("Script failed at line %d '%s' : %v\n", i+1, line, err)
+			ctr.killAll()
+			ctr.Halt()
+			os.Exit(1)
+		}
+	}
+	fmt.Println("Script passed")
+	ctr.killAll()
+	ctr.Halt()
+	os.Exit(0)
+}
+
+// Kills the boxes that I started and that are still alive
+func (ctr *ControllerAgent) killAll() {
+	for _, box := range ctr.boxes.Running() {
+		ctr.handleCommand(fmt.Sprintf("kill %s", box))
+	}
+}
+
+// Executes a line of the scenario
+func (ctr *ControllerAgent) runScriptCommand(line string) error {
+	lSlice := strings.Fields(line)
+	switch lSlice[0] {
+	case "exit":
+		// End the scenario here
+		return errExit
+	case "sleep":
+		if len(lSlice) != 2 {
+			return fmt.Errorf("usage: sleep <duration>")
+		}
+		d, err := time.ParseDuration(lSlice[1])
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+	case "await":
+		cond := lSlice[1:]
+		timeout := defaultAwaitTimeout
+		if len(cond) > 1 {
+			if d, err := time.ParseDuration(cond[len(cond)-1]); err == nil {
+				timeout = d
+				cond = cond[:len(cond)-1]
+			}
+		}
+		deadline := time.Now().Add(timeout)
+		for {
+			holds, err := ctr.evaluate(cond)
+			if err != nil || holds {
+				return err
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out after %v", timeout)
+			}
+			time.Sleep(statusPollInterval)
+		}
+	case "assert":
+		holds, err := ctr.evaluate(lSlice[1:])
+		if err == nil && !holds {
+			err = fmt.Errorf("assertion does not hold")
+		}
+		return err
+	default:
+		if !ctr.handleCommand(line) {
+			return fmt.Errorf("invalid command")
+		}
+	}
+	return nil
+}
+
+// Returns whether condition cond holds, after asking the agents involved for their
+// status
+func (ctr *ControllerAgent) evaluate(cond []string) (bool, error) {
+	if len(cond) == 0 {
+		return false, fmt.Errorf("missing condition")
+	}
+	r := ctr.reports
+	switch cond[0] {
+	case "commits":
+		if len(cond) != 3 {
+			return false, fmt.Errorf("usage: commits <clientID> <n>")
+		}
+		id, err1 := strconv.ParseUint(cond[1], 10, 16)
+		n, err2 := strconv.ParseUint(cond[2], 10, 64)
+		if _, ok := ctr.clients[c.ProcessID(id)]; err1 != nil || err2 != nil || !ok {
+			return false, fmt.Errorf("invalid condition")
+		}
+		ctr.send(c.ProcessID(id), "status")
+		time.Sleep(statusWait)
+		r.rmut.Lock()
+		defer r.rmut.Unlock()
+		return r.commits[c.ProcessID(id)] >= n, nil
+	case "executed":
+		if len(cond) != 3 {
+			return false, fmt.Errorf("usage: executed <replicaID|all> <n>")
+		}
+		n, err := strconv.ParseUint(cond[2], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid condition")
+		}
+		reps := ctr.replicas
+		if cond[1] != "all" {
+			id, err := strconv.ParseUint(cond[1], 10, 16)
+			if _, ok := ctr.replicas[c.ProcessID(id)]; err != nil || !ok {
+				return false, fmt.Errorf("invalid replica %s", cond[1])
+			}
+			reps = map[c.ProcessID]int{c.ProcessID(id): 0}
+		}
+		slotOuts := ctr.pollReplicas(reps)
+		for rep := range reps {
+			if slotOut, ok := slotOuts[rep]; !ok || slotOut < n {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "converged":
+		slotOuts := ctr.pollReplicas(ctr.replicas)
+		if len(slotOuts) == 0 {
+			return false, nil
+		}
+		for _, slotOut := range slotOuts {
+			for _, other := range slotOuts {
+				if slotOut != other {
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	case "consistent":
+		outstanding := 1
+		if len(cond) > 1 {
+			n, err := strconv.Atoi(cond[1])
+			if err != nil || n < 1 {
+				return false, fmt.Errorf("invalid outstanding %s", cond[1])
+			}
+			outstanding = n
+		}
+		return ctr.checkConsistency(outstanding)
+	}
+	return false, fmt.Errorf("unknown condition '%s'", cond[0])
+}
+
+// Asks the replicas reps for their status, and returns the slotOuts they report
+func (ctr *ControllerAgent) pollReplicas(reps map[c.ProcessID]int) map[c.ProcessID]uint64 {
+	r := ctr.reports
+	r.rmut.Lock()
+	for rep := range reps {
+		delete(r.slotOuts, rep)
+	}
+	r.rmut.Unlock()
+	for rep := range reps {
+		ctr.send(rep, "status")
+	}
+	time.Sleep(statusWait)
+	slotOuts := make(map[c.ProcessID]uint64)
+	r.rmut.Lock()
+	for rep := range reps {
+		if slotOut, ok := r.slotOuts[rep]; ok {
+			slotOuts[rep] = slotOut
+		}
+	}
+	r.rmut.Unlock()
+	return slotOuts
+}
+
+// Asks the replicas for their structured dumps, and checks those that were written
+func (ctr *ControllerAgent) checkConsistency(outstanding int) (bool, error) {
+	ctr.handleCommand("dump")
+	time.Sleep(statusWait)
+	r := ctr.reports
+	r.rmut.Lock()
+	paths := make([]string, 0, len(r.dumps))
+	for _, path := range r.dumps {
+		paths = append(paths, path)
+	}
+	r.rmut.Unlock()
+	if len(paths) == 0 {
+		return false, nil
+	}
+	dumps := make([]*Dump, 0, len(paths))
+	for _, path := range paths {
+		d, err := ReadDump(path)
+		if err != nil {
+			return false, err
+		}
+		dumps = append(dumps, d)
+	}
+	errs := CheckDumps(dumps, outstanding)
+	for _, e := range errs {
+		fmt.Println(e)
+	}
+	return len(errs) == 0, nil
+}
@@ -0,0 +1,161 @@
+package paxos
+
+// This file describes the client session table of a paxos replica.
+// The table records, for each client, which of its requests have been executed and
+// their results, so that a replica detects a duplicate request by
+// (clientID, epoch, reqNum) in constant time, both when the request is received and
+// when it is performed.
+// A client may have several requests in flight, which may be executed out of order.
+// A client starts a new epoch, i.e. a new session, by registering with the service.
+// Requests of earlier epochs are stale, and are never executed.
+
+import (
+	"strconv"
+	"sync"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Number of executed requests above the floor whose results a session caches.
+// It must exceed the number of outstanding requests of any client.
+const sessionCacheSize = 1024
+
+// Status of a request with respect to the session table
+const (
+	reqNew      = iota // the request has not been executed
+	reqExecuted        // the request has been executed
+	reqStale           // the request belongs to an epoch that has ended
+	reqFuture          // the request belongs to an epoch that has not started
+)
+
+// a session records the requests of one client epoch that have been executed
+type session struct {
+	Epoch   uint64
+	Nonce   uint64            // nonce of the registration that started Epoch
+	Floor   uint64            // every reqNum < Floor has been executed
+	Results map[uint64]string // reqNum -> result, for recently executed reqNums
+}
+
+// Returns true iff request reqNum has been executed
+func (s *session) isExecuted(reqNum uint64) bool {
+	if reqNum < s.Floor {
+		return true
+	}
+	_, ok := s.Results[reqNum]
+	return ok
+}
+
+// Records that request reqNum has been executed with the given result
+func (s *session) record(reqNum uint64, result string) {
+	s.Results[reqNum] = result
+	for {
+		if _, ok := s.Results[s.Floor]; !ok {
+			break
+		}
+		s.Floor++
+	}
+	for rn := range s.Results {
+		if rn+sessionCacheSize < s.Floor {
+			delete(s.Results, rn)
+		}
+	}
+}
+
+// sessionTable maps each client to its session
+type sessionTable struct {
+	sessions map[c.ProcessID]*session
+	smut     *sync.RWMutex // mutex for sessions map and its contents
+}
+
+// Constructor
+func newSessionTable() *sessionTable {
+	return &sessionTable{
+		sessions: make(map[c.ProcessID]*session),
+		smut:     new(sync.RWMutex)}
+}
+
+// Returns the status of req, and its result if it has been executed.
+// The result of an executed request that fell out of the cache is "".
+// The result of a registration is the epoch it started
+func (st *sessionTable) status(req *request) (string, int) {
+	st.smut.RLock()
+	defer st.smut.RUnlock()
+	s, ok := st.sessions[req.clientID]
+	switch {
+	case req.isRegistration():
+		if ok && s.Nonce == req.reqNum {
+			return strconv.FormatUint(s.Epoch, 10), reqExecuted
+		}
+		return "", reqNew
+	case !ok:
+		// Only reconfigurations need no registration
+		if req.isReconfig() {
+			return "", reqNew
+		}
+		return "", reqFuture
+	case req.epoch < s.Epoch:
+		return "", reqStale
+	case req.epoch > s.Epoch:
+		return "", reqFuture
+	case s.isExecuted(req.reqNum):
+		return s.Results[req.reqNum], reqExecuted
+	default:
+		return "", reqNew
+	}
+}
+
+// Records that req has been executed with the given result
+func (st *sessionTable) record(req *request, result string) {
+	st.smut.Lock()
+	defer st.smut.Unlock()
+	s, ok := st.sessions[req.clientID]
+	if !ok {
+		s = &session{Epoch: req.epoch, Floor: 0, Results: make(map[uint64]string)}
+		st.sessions[req.clientID] = s
+	}
+	s.record(req.reqNum, result)
+}
+
+// Returns a deep copy of the sessions, for a checkpoint
+func (st *sessionTable) snapshot() map[c.ProcessID]*session {
+	st.smut.RLock()
+	defer st.smut.RUnlock()
+	sessions := make(map[c.ProcessID]*session)
+	for cid, s := range st.sessions {
+		results := make(map[uint64]string)
+		for rn, result := range s.Results {
+			results[rn] = result
+		}
+		sessions[cid] = &session{s.Epoch, s.Nonce, s.Floor, results}
+	}
+	return sessions
+}
+
+// Replaces the sessions with those of a checkpoint
+func (st *sessionTable) restore(sessions map[c.ProcessID]*session) {
+	st.smut.Lock()
+	defer st.smut.Unlock()
+	st.sessions = sessions
+	for _, s := range st.sessions {
+		if s.Results == nil {
+			s.Results = make(map[uint64]string)
+		}
+	}
+}
+
+// Executes registration req, which starts a new epoch for its client. Returns the
+// new epoch as the result of req
+func (st *sessionTable) register(req *request) string {
+	st.smut.Lock()
+	defer st.smut.Unlock()
+	epoch := reconfigEpoch + 1 // epochs of clients are > reconfigEpoch
+	if s, ok := st.sessions[req.clientID]; ok {
+		epoch = s.Epoch + 1
+	}
+	st.sessions[req.clientID] = &session{
+		Epoch:   epoch,
+		Nonce:   req.reqNum,
+		Floor:   0,
+		Results: make(map[uint64]string)}
+	return strconv.FormatUint(epoch, 10)
+}
@@ -1,53 +1,71 @@
 package paxos
 
 import (
-	"fmt"
-	"time"
+	"sync"
 
 	c "github.com/TonyZhangND/GoOvid/commons"
 )
 
-type pingTimer struct {
-	inChan chan bool
-}
-
+// An unreliableFailureDetector tracks the processes believed to be leaders, and
+// the processes whose box is down, as the server reports it through
+// OnPeerStatus. It sends no pings of its own
 type unreliableFailureDetector struct {
-	replica *ReplicaAgent              // agent this ufd is bound to
-	alive   map[c.ProcessID]*pingTimer // alive[q]= pt iff q is thought to be alive
-	leaders map[c.ProcessID]bool       // set of processes believed to be the leader
+	replica *ReplicaAgent        // agent this ufd is bound to
+	leaders map[c.ProcessID]bool // set of processes believed to be the leader
+	down    map[c.ProcessID]bool // set of processes whose box the server reports down
+	lmut    *sync.RWMutex        // mutex for leaders and down
 }
 
 // Constructor for a new unreliableFailureDetector
 func newUnreliableFailureDetector(rep *ReplicaAgent) *unreliableFailureDetector {
 	ufd := unreliableFailureDetector{}
-	ufd.alive = make(map[c.ProcessID]*pingTimer)
 	ufd.leaders = make(map[c.ProcessID]bool)
+	ufd.down = make(map[c.ProcessID]bool)
+	ufd.lmut = new(sync.RWMutex)
 	ufd.replica = rep
 	return &ufd
 }
 
-// Begins sending pings into l.conn channel
-func (ufd *unreliableFailureDetector) runPinger() {
-	for ufd.replica.isActive {
-		var ping string
-		if _, ok := ufd.leaders[ufd.replica.myID]; ok {
-			// Replica believes that it is the leader
-			ping = fmt.Sprintf("ping %d leader", ufd.replica.myID)
-		} else {
-			ping = fmt.Sprintf("ping %d", ufd.replica.myID)
-		}
-		// Broadcast ping
-		for rep := range ufd.replica.replicas {
-			if rep != ufd.replica.myID {
-				ufd.replica.send(rep, ping)
-			}
-		}
-		time.Sleep(pingInterval)
+// Returns true iff process id is believed to be a leader
+func (ufd *unreliableFailureDetector) isLeader(id c.ProcessID) bool {
+	ufd.lmut.RLock()
+	defer ufd.lmut.RUnlock()
+	_, ok := ufd.leaders[id]
+	return ok
+}
+
+// Marks process id as believed to be a leader or not
+func (ufd *unreliableFailureDetector) setLeader(id c.ProcessID, leader bool) {
+	ufd.lmut.Lock()
+	defer ufd.lmut.Unlock()
+	if leader {
+		ufd.leaders[id] = true
+	} else {
+		delete(ufd.leaders, id)
+	}
+}
+
+// Returns true unless the box of process id is reported down
+func (ufd *unreliableFailureDetector) isUp(id c.ProcessID) bool {
+	ufd.lmut.RLock()
+	defer ufd.lmut.RUnlock()
+	return !ufd.down[id]
+}
+
+// Marks the box of process id as up or down
+func (ufd *unreliableFailureDetector) setUp(id c.ProcessID, up bool) {
+	ufd.lmut.Lock()
+	defer ufd.lmut.Unlock()
+	if up {
+		delete(ufd.down, id)
+	} else {
+		ufd.down[id] = true
 	}
 }
 
-// TODO: handle a ping of format "ping <sender> [leader]"
-func (ufd *unreliableFailureDetector) receivePing(ping string) {
-	// Idea is to push into pingTimer channel if process is thought to be alive,
-	// else add process p into alive set with alive[p] = new ping timer
+// OnPeerStatus records that the box of replica pid went up or down, as the
+// membership protocol of the server detects it
+func (rep *ReplicaAgent) OnPeerStatus(pid c.ProcessID, up bool) {
+	rep.failureDetector.setUp(pid, up)
+	rep.debugPrintf("Replica %d is up: %v\n", pid, up)
 }
@@ -1,30 +1,44 @@
 package configs
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"strconv"
 
 	a "github.com/TonyZhangND/GoOvid/agents"
 	c "github.com/TonyZhangND/GoOvid/commons"
 )
 
-// Prints the error messange and kills the program
-// if an error is detected
-func checkDecodeError(err error, dat string) {
-	c.CheckFatalOvidErrorf(err, "%v encountered decoding %v", err, dat)
+// Returns the error of decoding dat
+func decodeError(err error, dat string) error {
+	return fmt.Errorf("%v encountered decoding %v", err, dat)
+}
+
+// Helper: Parses box address s
+func parseBox(s string) (c.BoxID, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse box string %s", s)
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("cannot parse IP %s of box %s", host, s)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("cannot parse port %s of box %s", port, s)
+	}
+	return c.ParseBoxAddr(s), nil
 }
 
 // Helper: Parses the json object of an agent, returning a pointer to the
 // resulting AgentInfo struct
-func parseAgentObject(agentObj map[string]interface{}) *a.AgentInfo {
+func parseAgentObject(agentObj map[string]interface{}) (*a.AgentInfo, error) {
 	agent := &a.AgentInfo{} // alloc empty struct for the agent
 	for k, v := range agentObj {
 		switch k {
 		case "type":
-			switch v.(string) {
+			name, _ := v.(string)
+			switch name {
 			case "chat":
 				agent.Type = a.Chat
 			case "dummy":
@@ -41,32 +55,58 @@ func parseAgentObject(agentObj map[string]interface{}) *a.AgentInfo {
 				agent.Type = a.PaxosClient
 			case "paxos_controller":
 				agent.Type = a.PaxosController
+			case "paxos_leader":
+				agent.Type = a.PaxosLeader
+			case "paxos_acceptor":
+				agent.Type = a.PaxosAcceptor
 			default:
-				c.FatalOvidErrorf("Unknown agent type %v\n", v)
+				return nil, fmt.Errorf("unknown agent type %v", v)
 			}
 		case "box":
-			agent.Box = c.ParseBoxAddr(v.(string))
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid box %v", v)
+			}
+			box, err := parseBox(s)
+			if err != nil {
+				return nil, err
+			}
+			agent.Box = box
 		case "attrs":
-			agent.RawAttrs = v.(map[string]interface{})
+			attrs, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid attrs %v", v)
+			}
+			agent.RawAttrs = attrs
 		case "routes":
 			// initialize the routing table
 			routingTable := make(map[c.ProcessID]c.Route)
 
 			// iterate over each link
-			rts := v.(map[string]interface{})
+			rts, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid routes %v", v)
+			}
 			for vidRaw, rtRaw := range rts {
 				vid, err := strconv.ParseUint(vidRaw, 10, 16)
-				checkDecodeError(err, vidRaw)
-				rt := rtRaw.(map[string]interface{})
-				if len(rt) != 1 {
-					c.FatalOvidErrorf("Invalid route entry %v\n", rtRaw)
+				if err != nil {
+					return nil, decodeError(err, vidRaw)
+				}
+				rt, ok := rtRaw.(map[string]interface{})
+				if !ok || len(rt) != 1 {
+					return nil, fmt.Errorf("invalid route entry %v", rtRaw)
 				}
 				// parse the json object for the link
 				route := c.Route{} // alloc a Route struct to be filled
 				for pidRaw, portRaw := range rt {
 					pid, err := strconv.ParseUint(pidRaw, 10, 16)
-					checkDecodeError(err, pidRaw)
-					port := c.PortNum(portRaw.(float64))
+					if err != nil {
+						return nil, decodeError(err, pidRaw)
+					}
+					port, ok := portRaw.(float64)
+					if !ok {
+						return nil, fmt.Errorf("invalid port %v of route %s", portRaw, vidRaw)
+					}
 					route.DestID = c.ProcessID(pid)
 					route.DestPort = c.PortNum(port)
 				}
@@ -74,10 +114,10 @@ func parseAgentObject(agentObj map[string]interface{}) *a.AgentInfo {
 			}
 			agent.Routes = routingTable
 		default:
-			c.FatalOvidErrorf("Unknown agent field %v\n", k)
+			return nil, fmt.Errorf("unknown agent field %v", k)
 		}
 	}
-	return agent
+	return agent, nil
 }
 
 // IsValid returns false if config is detected as invalid. Otherwise returns true.
@@ -97,34 +137,69 @@ func isValid(config map[c.ProcessID]*a.AgentInfo) (bool, error) {
 	return true, nil
 }
 
-// Parse reads the ovid configuration in configFile, and returns a pointer
-// to a map containing the AgentInfo objects in the configuration
+// Parse reads the ovid configuration in configFile, which is in JSON, YAML or
+// TOML according to its extension, and returns a pointer to a map containing the
+// AgentInfo objects in the configuration. Parse exits if configFile is not a
+// valid configuration
 func Parse(configFile string) map[c.ProcessID]*a.AgentInfo {
-	// Read the file
-	dat, err := ioutil.ReadFile(configFile)
+	config, err := TryParse(configFile)
 	if err != nil {
-		c.FatalOvidErrorf("%v \n", err)
+		c.FatalOvidErrorf("%v\n", err)
 	}
+	return config
+}
 
-	// Decode the file into a map[string]interface{}
-	var rawMap interface{}
-	err = json.Unmarshal(dat, &rawMap)
-	checkDecodeError(err, configFile)
+// TryParse is like Parse, but returns an error instead of killing the program if
+// configFile is not a valid configuration
+func TryParse(configFile string) (map[c.ProcessID]*a.AgentInfo, error) {
+	// Read and decode the file into a map[string]interface{}
+	rawMap, err := readRaw(configFile)
+	if err != nil {
+		return nil, err
+	}
+	res, err := parseRaw(rawMap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", configFile, err)
+	}
+	return res, nil
+}
+
+// TryParseData is like TryParse, but parses dat, the contents of a configuration
+// file in the given format
+func TryParseData(dat []byte, format string) (map[c.ProcessID]*a.AgentInfo, error) {
+	rawMap, err := decode(dat, format)
+	if err != nil {
+		return nil, fmt.Errorf("%v encountered decoding configuration", err)
+	}
+	res, err := parseRaw(rawMap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return res, nil
+}
 
-	// Decode map[string]interface{} into a new AgentInfo struct, and return a
-	// map containing all the agents
+// Helper: Parses the decoded configuration rawMap
+func parseRaw(rawMap interface{}) (map[c.ProcessID]*a.AgentInfo, error) {
+	// Expand the groups, and decode each agent object into a new AgentInfo
+	// struct, and return a map containing all the agents
+	m, ok := rawMap.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an object of agents")
+	}
+	agents, err := expandGroups(m)
+	if err != nil {
+		return nil, err
+	}
 	res := make(map[c.ProcessID]*a.AgentInfo)
-	m := rawMap.(map[string]interface{})
-	for id, obj := range m {
-		pid, err := strconv.ParseUint(id, 10, 16)
-		checkDecodeError(err, configFile)
-		res[c.ProcessID(pid)] = parseAgentObject(obj.(map[string]interface{}))
+	for pid, obj := range agents {
+		if res[pid], err = parseAgentObject(obj); err != nil {
+			return nil, fmt.Errorf("agent %d: %v", pid, err)
+		}
 	}
 
 	// check for validity
-	ok, err := isValid(res)
-	if !ok {
-		c.FatalOvidErrorf("%v \n", err)
+	if ok, err := isValid(res); !ok {
+		return nil, err
 	}
-	return res
+	return res, nil
 }
@@ -0,0 +1,192 @@
+package configs
+
+// This file contains the decoders and encoders of the formats of configuration
+// files. Besides JSON, a configuration may be written in YAML or TOML, which allow
+// comments. The format of a file is given by its extension: .json, .yaml or .yml,
+// and .toml. Whatever its format, a configuration decodes to the same values as
+// the equivalent JSON, i.e. objects with string keys, lists, strings, booleans and
+// float64 numbers, so that the parser and the agents need not know the format.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+
+	toml "github.com/pelletier/go-toml/v2"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Formats of configuration files
+const (
+	JSON = "json"
+	YAML = "yaml"
+	TOML = "toml"
+)
+
+// Format returns the format of the configuration file at path, by its extension
+func Format(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return JSON, nil
+	case ".yaml", ".yml":
+		return YAML, nil
+	case ".toml":
+		return TOML, nil
+	}
+	return "", fmt.Errorf("unknown format of configuration file %s", path)
+}
+
+// Returns the JSON value equivalent to value v decoded from YAML or TOML
+func normalize(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			n, err := normalize(item)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = n
+		}
+		return res, nil
+	case map[interface{}]interface{}:
+		// YAML keys that are not strings, e.g. agent IDs
+		res := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			n, err := normalize(item)
+			if err != nil {
+				return nil, err
+			}
+			res[fmt.Sprint(k)] = n
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			n, err := normalize(item)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = n
+		}
+		return res, nil
+	case int:
+		return float64(val), nil
+	case int64:
+		return float64(val), nil
+	case uint64:
+		return float64(val), nil
+	case float64, string, bool, nil:
+		return val, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v of type %T", v, v)
+}
+
+// Returns the values of dat, a configuration in the given format
+func decode(dat []byte, format string) (interface{}, error) {
+	var raw interface{}
+	switch format {
+	case JSON:
+		err := json.Unmarshal(dat, &raw)
+		return raw, err
+	case YAML:
+		if err := yaml.Unmarshal(dat, &raw); err != nil {
+			return nil, err
+		}
+	case TOML:
+		if err := toml.Unmarshal(dat, &raw); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+	return normalize(raw)
+}
+
+// Returns value v with its integral numbers as integers, so that they are not
+// encoded as floats, e.g. 1.0 in TOML
+func integers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			res[k] = integers(item)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = integers(item)
+		}
+		return res
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) < 1<<53 {
+			return int64(val)
+		}
+	}
+	return v
+}
+
+// Returns the encoding of the values of a configuration in the given format
+func encode(raw interface{}, format string) ([]byte, error) {
+	switch format {
+	case JSON:
+		dat, err := json.MarshalIndent(raw, "", "\t")
+		return append(dat, '\n'), err
+	case YAML:
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(integers(raw)); err != nil {
+			return nil, err
+		}
+		err := enc.Close()
+		return buf.Bytes(), err
+	case TOML:
+		return toml.Marshal(integers(raw))
+	}
+	return nil, fmt.Errorf("unknown format %s", format)
+}
+
+// Reads the configuration file at path, in any format
+func readRaw(path string) (interface{}, error) {
+	format, err := Format(path)
+	if err != nil {
+		return nil, err
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decode(dat, format)
+	if err != nil {
+		return nil, fmt.Errorf("%v encountered decoding %s", err, path)
+	}
+	return raw, nil
+}
+
+// Convert writes the configuration file in to out, in the format given by the
+// extension of out. Groups and references are kept as they are. Nothing is
+// written if in is not a valid configuration
+func Convert(in, out string) error {
+	if _, err := TryParse(in); err != nil {
+		return err
+	}
+	raw, err := readRaw(in)
+	if err != nil {
+		return err
+	}
+	format, err := Format(out)
+	if err != nil {
+		return err
+	}
+	dat, err := encode(raw, format)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, dat, 0644)
+}
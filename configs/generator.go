@@ -0,0 +1,295 @@
+package configs
+
+// This file contains the generators of configurations for the built-in topologies
+// of GoOvid: a paxos service, a kvs shared by a set of clients, and a chat mesh.
+// Agent IDs and box ports are offsets from an ID base and a port base, so that
+// several grids can run side by side on the same machine.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// GenOptions are the options common to all topologies
+type GenOptions struct {
+	IDBase   int    // agent IDs are offsets from IDBase
+	PortBase int    // box ports are offsets from PortBase
+	IP       string // IP address of every box
+}
+
+// AgentSpec is the JSON object of an agent in a configuration
+type AgentSpec struct {
+	Type   string                    `json:"type"`
+	Box    string                    `json:"box"`
+	Attrs  map[string]interface{}    `json:"attrs"`
+	Routes map[string]map[string]int `json:"routes"`
+}
+
+// Config is a generated configuration, mapping agent IDs to their specs
+type Config map[int]*AgentSpec
+
+// Adds agent id, of type t, on the box at port
+func (cfg Config) add(id int, t string, opts *GenOptions, port int) *AgentSpec {
+	spec := &AgentSpec{
+		Type:   t,
+		Box:    fmt.Sprintf("%s:%d", opts.IP, opts.PortBase+port),
+		Attrs:  make(map[string]interface{}),
+		Routes: make(map[string]map[string]int)}
+	cfg[id] = spec
+	return spec
+}
+
+// Adds a route from the agent to physical dest, on the given port, with virtual ID
+// vdest
+func (spec *AgentSpec) route(vdest, dest, port int) {
+	spec.Routes[strconv.Itoa(vdest)] = map[string]int{strconv.Itoa(dest): port}
+}
+
+// Adds routes to each agent of dests, on the given port, with vdest = physical ID
+func (spec *AgentSpec) routeAll(dests []int, port int) {
+	for _, dest := range dests {
+		spec.route(dest, dest, port)
+	}
+}
+
+// Returns the IDs base+offset, for offsets from first to first+n-1
+func idRange(base, first, n int) []int {
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = base + first + i
+	}
+	return ids
+}
+
+// PaxosOptions are the options of a paxos topology
+type PaxosOptions struct {
+	F         int    // number of failures tolerated
+	Clients   int    // number of clients
+	Mode      string // mode of the clients, script or manual
+	Separated bool   // f+1 replicas, f+1 leaders and 2f+1 acceptors as separate agents
+	Script    string // scenario of the controller, "" to read stdin
+}
+
+// Offsets of the IDs and ports of the agents of a paxos topology. Clients listen on
+// ports offset by paxosClientPorts, and the controller on paxosControllerPort
+const (
+	paxosReplicaIDs     = 1
+	paxosClientIDs      = 100
+	paxosLeaderIDs      = 200
+	paxosAcceptorIDs    = 300
+	paxosControllerID   = 999
+	paxosClientPorts    = 3000
+	paxosControllerPort = 4999
+)
+
+// GeneratePaxos returns the configuration of a paxos service, with a controller
+func GeneratePaxos(p *PaxosOptions, opts *GenOptions) (Config, error) {
+	if p.F < 1 || p.Clients < 1 {
+		return nil, fmt.Errorf("paxos needs f > 0 and at least one client")
+	}
+	if p.Mode != "script" && p.Mode != "manual" {
+		return nil, fmt.Errorf("invalid client mode '%s'", p.Mode)
+	}
+	nReplicas, leaders, acceptors := 2*p.F+1, []int{}, []int{}
+	if p.Separated {
+		nReplicas = p.F + 1
+		leaders = idRange(opts.IDBase, paxosLeaderIDs, p.F+1)
+		acceptors = idRange(opts.IDBase, paxosAcceptorIDs, 2*p.F+1)
+	}
+	replicas := idRange(opts.IDBase, paxosReplicaIDs, nReplicas)
+	clients := idRange(opts.IDBase, paxosClientIDs, p.Clients)
+	ctrID := opts.IDBase + paxosControllerID
+	cfg := make(Config)
+	for _, id := range replicas {
+		spec := cfg.add(id, "paxos_replica", opts, id-opts.IDBase)
+		spec.Attrs["myid"] = id
+		spec.Attrs["replicas"] = replicas
+		spec.Attrs["clients"] = clients
+		spec.Attrs["output"] = fmt.Sprintf("tmp/replica_%d.output", id)
+		spec.Attrs["controller"] = ctrID
+		// replicas listen for replicas, leaders and acceptors on port 1, as do
+		// clients for replicas, and the controller for reports
+		spec.routeAll(replicas, 1)
+		spec.routeAll(clients, 1)
+		spec.routeAll([]int{ctrID}, 1)
+		if p.Separated {
+			spec.Attrs["leaders"] = leaders
+			spec.Attrs["acceptors"] = acceptors
+			spec.routeAll(leaders, 1)
+			spec.routeAll(acceptors, 1)
+		} else {
+			spec.Attrs["log"] = fmt.Sprintf("tmp/replica_%d.log", id)
+		}
+	}
+	for _, id := range leaders {
+		spec := cfg.add(id, "paxos_leader", opts, id-opts.IDBase)
+		spec.Attrs["myid"] = id
+		spec.Attrs["replicas"] = replicas
+		spec.Attrs["acceptors"] = acceptors
+		spec.routeAll(acceptors, 1)
+		spec.routeAll(replicas, 1)
+	}
+	for _, id := range acceptors {
+		spec := cfg.add(id, "paxos_acceptor", opts, id-opts.IDBase)
+		spec.Attrs["myid"] = id
+		spec.Attrs["replicas"] = replicas
+		spec.Attrs["log"] = fmt.Sprintf("tmp/replica_%d.log", id)
+		spec.routeAll(leaders, 1)
+	}
+	for _, id := range clients {
+		spec := cfg.add(id, "paxos_client", opts, paxosClientPorts+id-opts.IDBase)
+		spec.Attrs["myid"] = id
+		spec.Attrs["replicas"] = replicas
+		spec.Attrs["mode"] = p.Mode
+		spec.Attrs["controller"] = ctrID
+		// replicas listen for clients on port 2
+		spec.routeAll(replicas, 2)
+		spec.routeAll([]int{ctrID}, 1)
+	}
+	ctr := cfg.add(ctrID, "paxos_controller", opts, paxosControllerPort)
+	ctr.Attrs["replicas"] = replicas
+	ctr.Attrs["clients"] = clients
+	if p.Script != "" {
+		ctr.Attrs["script"] = p.Script
+	}
+	// all agents listen for the controller on port 9
+	ctr.routeAll(replicas, 9)
+	ctr.routeAll(clients, 9)
+	return cfg, nil
+}
+
+// GenerateKVS returns the configuration of a kvs replica shared by n clients, each
+// driven by a tty on its box. Client i and its tty are on the box at port base+i,
+// and the kvs on the box at port base+n
+func GenerateKVS(n int, opts *GenOptions) (Config, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("kvs needs at least one client")
+	}
+	cfg := make(Config)
+	kvsID := opts.IDBase + 300
+	kvs := cfg.add(kvsID, "kvs_replica", opts, n)
+	kvs.Attrs["log"] = fmt.Sprintf("tmp/%d.log", kvsID)
+	for i := 0; i < n; i++ {
+		ttyID, cltID := opts.IDBase+100+i, opts.IDBase+200+i
+		// the tty sends commands to its client at vdest 1, port 1
+		tty := cfg.add(ttyID, "kvs_tty", opts, i)
+		tty.route(1, cltID, 1)
+		// the client expects its tty at vdest 1, port 1, and the kvs at vdest 2,
+		// port 1
+		clt := cfg.add(cltID, "kvs_client", opts, i)
+		clt.Attrs["myid"] = cltID
+		clt.route(1, ttyID, 1)
+		clt.route(2, kvsID, 1)
+		// the kvs replies to the client with vdest its physical ID, on port 2
+		kvs.route(cltID, cltID, 2)
+	}
+	return cfg, nil
+}
+
+// Names of the members of a chat mesh
+var chatNames = []string{"alice", "bob", "charles", "dave", "eve", "frank", "grace", "heidi"}
+
+// GenerateChat returns the configuration of a mesh of n chat agents, each on its
+// own box, where every agent has every other as contact
+func GenerateChat(n int, opts *GenOptions) (Config, error) {
+	if n < 2 {
+		return nil, fmt.Errorf("chat needs at least two members")
+	}
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = opts.IDBase + 10*(i+1)
+	}
+	cfg := make(Config)
+	for i, id := range ids {
+		spec := cfg.add(id, "chat", opts, i)
+		name := fmt.Sprintf("member%d", i)
+		if i < len(chatNames) {
+			name = chatNames[i]
+		}
+		spec.Attrs["myname"] = name
+		contacts := make([]int, 0, n-1)
+		for _, other := range ids {
+			if other != id {
+				contacts = append(contacts, other)
+			}
+		}
+		spec.Attrs["contacts"] = contacts
+		// chat agents listen for each other on port 100
+		spec.routeAll(contacts, 100)
+	}
+	return cfg, nil
+}
+
+// Write validates cfg, and writes it to path, in the format given by its
+// extension, or in JSON to stdout if path is "". Nothing is written if cfg is
+// invalid
+func (cfg Config) Write(path string) error {
+	ids := make([]int, 0, len(cfg))
+	for id := range cfg {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	// Keys of a JSON object are sorted as strings, so order the agents by ID by hand
+	dat := []byte("{\n")
+	for i, id := range ids {
+		spec, err := json.MarshalIndent(cfg[id], "\t", "\t")
+		if err != nil {
+			return err
+		}
+		dat = append(dat, fmt.Sprintf("\t\"%d\" : %s", id, spec)...)
+		if i < len(ids)-1 {
+			dat = append(dat, ',')
+		}
+		dat = append(dat, '\n')
+	}
+	dat = append(dat, "}\n"...)
+
+	ext := ".json"
+	if path != "" {
+		format, err := Format(path)
+		if err != nil {
+			return err
+		}
+		if format != JSON {
+			raw, err := decode(dat, JSON)
+			if err != nil {
+				return err
+			}
+			if dat, err = encode(raw, format); err != nil {
+				return err
+			}
+		}
+		ext = filepath.Ext(path)
+	}
+	if err := validate(dat, ext); err != nil {
+		return err
+	}
+	if path == "" {
+		_, err := os.Stdout.Write(dat)
+		return err
+	}
+	return ioutil.WriteFile(path, dat, 0644)
+}
+
+// Returns the error of parsing dat as a configuration file with extension ext
+func validate(dat []byte, ext string) error {
+	f, err := ioutil.TempFile("", "ovid_config_*"+ext)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(dat)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = TryParse(f.Name())
+	return err
+}
@@ -0,0 +1,274 @@
+package configs
+
+// This file expands the agent groups of a configuration into plain agents.
+// A configuration may have a "groups" object besides its agents, e.g.
+//
+//	"groups": {
+//		"acceptors": {
+//			"type": "paxos_acceptor",
+//			"count": 5,
+//			"idBase": 301,
+//			"boxBase": "127.0.0.1:5301",
+//			"attrs": { "myid": "@id", "log": "tmp/acceptor_{id}.log" },
+//			"routes": { "@leaders": 1 }
+//		}
+//	}
+//
+// Member i of a group has ID idBase+i, and runs on the box at the port of boxBase
+// plus i. A group may give "box" instead of "boxBase" to put all its members on
+// the same box. The attrs and routes of a group are those of each of its members.
+// In the attrs and routes of any agent,
+//
+//	"@<group>"    as an attr value is the list of the IDs of the group, and as an
+//	              item of a list is spliced into the list
+//	"@id"         as an attr value is the ID of the agent
+//	"{id}"        in a string attr is replaced by the ID of the agent
+//	"@<group>": p as a route is a route to each member of the group on port p,
+//	              with virtual ID the physical ID of the member
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Reference to the ID of the agent itself
+const selfRef = "@id"
+
+// Returns the field k of group obj as an integer
+func groupInt(name string, obj map[string]interface{}, k string) (int, error) {
+	v, ok := obj[k].(float64)
+	if !ok || v < 0 || v != float64(int(v)) {
+		return 0, fmt.Errorf("group %s has invalid or missing %s %v", name, k, obj[k])
+	}
+	return int(v), nil
+}
+
+// Returns the IDs of the members of each group of groupsObj
+func groupIDs(groupsObj map[string]interface{}) (map[string][]c.ProcessID, error) {
+	ids := make(map[string][]c.ProcessID)
+	for name, gRaw := range groupsObj {
+		if "@"+name == selfRef {
+			return nil, fmt.Errorf("invalid group name %s", name)
+		}
+		g, ok := gRaw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid group %s", name)
+		}
+		count, err := groupInt(name, g, "count")
+		if err != nil {
+			return nil, err
+		}
+		idBase, err := groupInt(name, g, "idBase")
+		if err != nil {
+			return nil, err
+		}
+		if count < 1 || idBase+count-1 > 65535 {
+			return nil, fmt.Errorf("group %s has invalid count %d", name, count)
+		}
+		ids[name] = make([]c.ProcessID, count)
+		for i := range ids[name] {
+			ids[name][i] = c.ProcessID(idBase + i)
+		}
+	}
+	return ids, nil
+}
+
+// Returns the box of member i of group obj
+func groupBox(name string, obj map[string]interface{}, i int) (string, error) {
+	if box, ok := obj["box"].(string); ok {
+		return box, nil
+	}
+	base, ok := obj["boxBase"].(string)
+	if !ok {
+		return "", fmt.Errorf("group %s has no box or boxBase", name)
+	}
+	host, portStr, err := net.SplitHostPort(base)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse boxBase %s of group %s", base, name)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse boxBase %s of group %s", base, name)
+	}
+	if port+uint64(i) > 65535 {
+		return "", fmt.Errorf("group %s has too many members for boxBase %s", name, base)
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(port+uint64(i), 10)), nil
+}
+
+// Returns the JSON value of the IDs of group name
+func idsValue(ids []c.ProcessID) []interface{} {
+	res := make([]interface{}, len(ids))
+	for i, id := range ids {
+		res[i] = float64(id)
+	}
+	return res
+}
+
+// Returns attr value v of agent self, with its references resolved
+func resolveAttr(v interface{}, self c.ProcessID,
+	groups map[string][]c.ProcessID) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		if val == selfRef {
+			return float64(self), nil
+		}
+		if strings.HasPrefix(val, "@") {
+			ids, ok := groups[val[1:]]
+			if !ok {
+				return nil, fmt.Errorf("unknown group %s in attrs of agent %d", val, self)
+			}
+			return idsValue(ids), nil
+		}
+		return strings.Replace(val, "{id}", strconv.Itoa(int(self)), -1), nil
+	case []interface{}:
+		res := make([]interface{}, 0, len(val))
+		for _, item := range val {
+			r, err := resolveAttr(item, self, groups)
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := item.(string); ok && s != selfRef && strings.HasPrefix(s, "@") {
+				// splice the group
+				res = append(res, r.([]interface{})...)
+			} else {
+				res = append(res, r)
+			}
+		}
+		return res, nil
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			r, err := resolveAttr(item, self, groups)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = r
+		}
+		return res, nil
+	}
+	return v, nil
+}
+
+// Returns routing table rts of agent self, with its group routes expanded
+func resolveRoutes(rts map[string]interface{}, self c.ProcessID,
+	groups map[string][]c.ProcessID) (map[string]interface{}, error) {
+	res := make(map[string]interface{}, len(rts))
+	// expand group routes first, so that plain routes override them
+	keys := make([]string, 0, len(rts))
+	for k := range rts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "@") {
+			continue
+		}
+		ids, ok := groups[k[1:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown group %s in routes of agent %d", k, self)
+		}
+		port, ok := rts[k].(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid port %v of route %s of agent %d", rts[k], k, self)
+		}
+		for _, id := range ids {
+			pid := strconv.Itoa(int(id))
+			res[pid] = map[string]interface{}{pid: port}
+		}
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "@") {
+			res[k] = rts[k]
+		}
+	}
+	return res, nil
+}
+
+// Returns agent object obj of agent self, with its references resolved
+func resolveAgent(obj map[string]interface{}, self c.ProcessID,
+	groups map[string][]c.ProcessID) (map[string]interface{}, error) {
+	res := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		res[k] = v
+	}
+	if attrs, ok := obj["attrs"].(map[string]interface{}); ok {
+		r, err := resolveAttr(attrs, self, groups)
+		if err != nil {
+			return nil, err
+		}
+		res["attrs"] = r
+	}
+	if rts, ok := obj["routes"].(map[string]interface{}); ok {
+		r, err := resolveRoutes(rts, self, groups)
+		if err != nil {
+			return nil, err
+		}
+		res["routes"] = r
+	}
+	return res, nil
+}
+
+// Returns the agents of configuration m, i.e. its plain agents and the members of
+// its groups, keyed by ID, with their references resolved
+func expandGroups(m map[string]interface{}) (map[c.ProcessID]map[string]interface{}, error) {
+	groupsObj := make(map[string]interface{})
+	if g, ok := m["groups"]; ok {
+		if groupsObj, ok = g.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("invalid groups %v", g)
+		}
+	}
+	groups, err := groupIDs(groupsObj)
+	if err != nil {
+		return nil, err
+	}
+
+	agents := make(map[c.ProcessID]map[string]interface{})
+	for id, obj := range m {
+		if id == "groups" {
+			continue
+		}
+		pid, err := strconv.ParseUint(id, 10, 16)
+		if err != nil {
+			return nil, decodeError(err, id)
+		}
+		agentObj, ok := obj.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid agent %s", id)
+		}
+		if agents[c.ProcessID(pid)], err = resolveAgent(agentObj, c.ProcessID(pid), groups); err != nil {
+			return nil, err
+		}
+	}
+	for name, ids := range groups {
+		g := groupsObj[name].(map[string]interface{})
+		for i, id := range ids {
+			if _, ok := agents[id]; ok {
+				return nil, fmt.Errorf("agent %d of group %s is already defined", id, name)
+			}
+			box, err := groupBox(name, g, i)
+			if err != nil {
+				return nil, err
+			}
+			agentObj := map[string]interface{}{"box": box}
+			for k, v := range g {
+				switch k {
+				case "type", "attrs", "routes":
+					agentObj[k] = v
+				case "count", "idBase", "box", "boxBase":
+				default:
+					return nil, fmt.Errorf("unknown field %s of group %s", k, name)
+				}
+			}
+			if agents[id], err = resolveAgent(agentObj, id, groups); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return agents, nil
+}
@@ -0,0 +1,172 @@
+package history
+
+// This file contains a linearizability checker in the style of Porcupine, i.e. the
+// algorithm of Wing & Gong with the memoization of Lowe.
+// The checker searches for an order of the operations that respects real time and
+// the sequential specification of the model. It walks a list of the call and return
+// events sorted by time, and tentatively linearizes the operation of every call it
+// meets. Meeting a return means that the operation returning has not been
+// linearized in time, so the checker backtracks. Configurations, i.e. a set of
+// linearized operations and a state, that were already explored are skipped.
+// A pending operation has no return, so it may be linearized at any point after its
+// call, or never.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// an entry is a call or return event in the doubly linked list of the checker
+type entry struct {
+	op         int // index of the operation
+	isCall     bool
+	match      *entry // return entry of a call, nil if the operation is pending
+	prev, next *entry
+}
+
+// Removes call entry e and its return from the list
+func (e *entry) lift() {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	if r := e.match; r != nil {
+		r.prev.next = r.next
+		if r.next != nil {
+			r.next.prev = r.prev
+		}
+	}
+}
+
+// Puts lifted call entry e and its return back into the list
+func (e *entry) unlift() {
+	if r := e.match; r != nil {
+		r.prev.next = r
+		if r.next != nil {
+			r.next.prev = r
+		}
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+// Returns the list of events of ops, headed by a sentinel. Of events at the same
+// time, calls come first, so that such operations are considered concurrent
+func makeEntries(ops []*Operation) *entry {
+	type event struct {
+		time   int64
+		isCall bool
+		e      *entry
+	}
+	events := make([]event, 0, 2*len(ops))
+	for i, op := range ops {
+		call := &entry{op: i, isCall: true}
+		events = append(events, event{op.Call, true, call})
+		if !op.Pending {
+			call.match = &entry{op: i}
+			events = append(events, event{op.Return, false, call.match})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].isCall && !events[j].isCall
+	})
+	head := &entry{op: -1}
+	last := head
+	for _, ev := range events {
+		last.next, ev.e.prev = ev.e, last
+		last = ev.e
+	}
+	return head
+}
+
+// a bitset of linearized operations
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) key(state string) string {
+	var sb strings.Builder
+	for _, w := range b {
+		fmt.Fprintf(&sb, "%x.", w)
+	}
+	sb.WriteString(state)
+	return sb.String()
+}
+
+// Returns true iff ops, a history of a single partition, is linearizable
+func checkPartition(model *Model, ops []*Operation) bool {
+	head := makeEntries(ops)
+	remaining := 0 // completed operations not linearized yet
+	for _, op := range ops {
+		if !op.Pending {
+			remaining++
+		}
+	}
+	type frame struct {
+		e     *entry
+		state string
+	}
+	state := model.Init()
+	linearized := make(bitset, (len(ops)+63)/64)
+	seen := make(map[string]bool)
+	stack := make([]frame, 0)
+	e := head.next
+	for remaining > 0 {
+		if e.isCall {
+			if ok, next := model.Step(state, ops[e.op]); ok {
+				linearized.set(e.op)
+				key := linearized.key(next)
+				if !seen[key] {
+					seen[key] = true
+					stack = append(stack, frame{e, state})
+					state = next
+					if e.match != nil {
+						remaining--
+					}
+					e.lift()
+					e = head.next
+					continue
+				}
+				linearized.clear(e.op)
+			}
+			e = e.next
+			continue
+		}
+		// An operation returned before it could be linearized. Backtrack
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.e.op)
+		if top.e.match != nil {
+			remaining++
+		}
+		top.e.unlift()
+		e = top.e.next
+	}
+	return true
+}
+
+// Check returns whether the history ops is linearizable with respect to model. If
+// it is not, it also returns the operations of a partition that is not
+func Check(model *Model, ops []*Operation) (bool, []*Operation) {
+	partitions := [][]*Operation{ops}
+	if model.Partition != nil {
+		partitions = model.Partition(ops)
+	}
+	for _, p := range partitions {
+		if !checkPartition(model, p) {
+			return false, p
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,142 @@
+package history
+
+// This file describes the histories that client agents record of the operations they
+// issue to a service, and how they are read back for checking.
+// A history is a file of JSON events, one per line. Every operation has an invoke
+// event, recorded when the client issues it, and a complete event, recorded when the
+// client receives its response. An operation without a complete event was still
+// pending when the client stopped, and may or may not have taken effect.
+// A restarted client appends to the same history under a new session, so operations
+// are identified by (client, session, op).
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Kinds of events
+const (
+	invokeEvent   = "invoke"
+	completeEvent = "complete"
+)
+
+// Event is one line of a history file
+type Event struct {
+	Client  c.ProcessID
+	Session int64 // start time of the recorder, in nanoseconds
+	Op      uint64
+	Kind    string
+	Value   string // input of an invoke event, output of a complete event
+	Time    int64  // in nanoseconds
+}
+
+// Recorder appends the events of a client to its history file
+type Recorder struct {
+	client  c.ProcessID
+	session int64
+	f       *os.File
+	enc     *json.Encoder
+	mut     *sync.Mutex
+}
+
+// NewRecorder returns a recorder of the events of client to the history at path
+func NewRecorder(path string, client c.ProcessID) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		client:  client,
+		session: time.Now().UnixNano(),
+		f:       f,
+		enc:     json.NewEncoder(f),
+		mut:     new(sync.Mutex)}, nil
+}
+
+// Records that operation op was issued with the given input
+func (r *Recorder) Invoke(op uint64, input string) {
+	r.record(op, invokeEvent, input)
+}
+
+// Complete records that operation op returned the given output
+func (r *Recorder) Complete(op uint64, output string) {
+	r.record(op, completeEvent, output)
+}
+
+func (r *Recorder) record(op uint64, kind, value string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	// Encode writes the whole line at once, so a crash never leaves half an event
+	r.enc.Encode(&Event{r.client, r.session, op, kind, value, time.Now().UnixNano()})
+}
+
+// Close closes the history file
+func (r *Recorder) Close() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.f.Close()
+}
+
+// Operation is an operation of a history, with its invoke and complete times
+type Operation struct {
+	Client  c.ProcessID
+	Input   string
+	Output  string // "" if pending
+	Call    int64
+	Return  int64
+	Pending bool // true iff the operation never completed
+}
+
+// ReadHistories reads the operations of the histories at paths, sorted by call time
+func ReadHistories(paths ...string) ([]*Operation, error) {
+	type opID struct {
+		client  c.ProcessID
+		session int64
+		op      uint64
+	}
+	ops := make(map[opID]*Operation)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			e := new(Event)
+			if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: invalid event: %v", path, line, err)
+			}
+			id := opID{e.Client, e.Session, e.Op}
+			switch e.Kind {
+			case invokeEvent:
+				ops[id] = &Operation{Client: e.Client, Input: e.Value, Call: e.Time, Pending: true}
+			case completeEvent:
+				if op, ok := ops[id]; ok && op.Pending {
+					op.Output, op.Return, op.Pending = e.Value, e.Time, false
+				}
+			default:
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: unknown event kind '%s'", path, line, e.Kind)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	res := make([]*Operation, 0, len(ops))
+	for _, op := range ops {
+		res = append(res, op)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Call < res[j].Call })
+	return res, nil
+}
@@ -0,0 +1,95 @@
+package history
+
+// This file describes the sequential specifications that histories are checked
+// against.
+// States are strings, so that the checker can compare and memoize them cheaply.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Model is the sequential specification of a service
+type Model struct {
+	Name string
+	// Init returns the initial state
+	Init func() string
+	// Step returns whether op may be applied to state, and the resulting state. The
+	// output of a pending op is unknown, so any output is allowed
+	Step func(state string, op *Operation) (bool, string)
+	// Partition splits a history into independent histories, or is nil
+	Partition func(ops []*Operation) [][]*Operation
+}
+
+// Models are the models known to the checker, by name
+var Models = map[string]*Model{
+	"kvs": KVSModel,
+	"log": LogModel,
+}
+
+// KVSModel specifies the kvs agent. Inputs are "put <key> <value>" and "get <key>",
+// and outputs are the responses of the kvs, "putok", "getok <value>" or "getbad".
+// Keys are independent, so histories are partitioned by key, and the state is the
+// value of the key prefixed by "=", or "" if it has none
+var KVSModel = &Model{
+	Name: "kvs",
+	Init: func() string { return "" },
+	Step: func(state string, op *Operation) (bool, string) {
+		in := strings.SplitN(op.Input, " ", 3)
+		switch {
+		case in[0] == "put" && len(in) == 3:
+			return op.Pending || op.Output == "putok", "=" + in[2]
+		case in[0] == "get" && len(in) == 2:
+			if op.Pending {
+				return true, state
+			}
+			if state == "" {
+				return op.Output == "getbad", state
+			}
+			return op.Output == "getok "+state[1:], state
+		}
+		return false, state
+	},
+	Partition: func(ops []*Operation) [][]*Operation {
+		byKey := make(map[string][]*Operation)
+		keys := make([]string, 0)
+		for _, op := range ops {
+			in := strings.SplitN(op.Input, " ", 3)
+			key := ""
+			if len(in) > 1 {
+				key = in[1]
+			}
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		res := make([][]*Operation, 0, len(keys))
+		for _, k := range keys {
+			res = append(res, byKey[k])
+		}
+		return res
+	},
+}
+
+// LogModel specifies an append-only log, such as the chat log of the paxos service.
+// Inputs are "append <entry>" and "read", and outputs are the index of the appended
+// entry, and "<length> [<last entry>]" respectively.
+// Every append returns its index, so the state need only be "<length> [<last entry>]"
+var LogModel = &Model{
+	Name: "log",
+	Init: func() string { return "0" },
+	Step: func(state string, op *Operation) (bool, string) {
+		length := 0
+		fmt.Sscanf(state, "%d", &length)
+		in := strings.SplitN(op.Input, " ", 2)
+		switch {
+		case in[0] == "append" && len(in) == 2:
+			ok := op.Pending || op.Output == fmt.Sprintf("%d", length)
+			return ok, fmt.Sprintf("%d %s", length+1, in[1])
+		case in[0] == "read":
+			return op.Pending || op.Output == state, state
+		}
+		return false, state
+	},
+}
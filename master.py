@@ -42,6 +42,14 @@ class ClientHandler(Thread):
                     sys.stdout.write(l + '\n')
                     sys.stdout.flush()
                     wait_ack = False
+                elif s[0] == 'reloaded':
+                    sys.stdout.write(l + '\n')
+                    sys.stdout.flush()
+                    wait_ack = False
+                elif s[0] == 'migrated':
+                    sys.stdout.write(l + '\n')
+                    sys.stdout.flush()
+                    wait_ack = False
                 else:
                     print("Invalid Response: " + l)
             else:
@@ -191,13 +199,13 @@ def main(configFile, debug=False):
             handler = ClientHandler(boxID, address, port, process)
             threads[boxID] = handler
             handler.start()
-        elif cmd == 'get' or cmd == 'alive':
+        elif cmd == 'get' or cmd == 'alive' or cmd == 'reload' or cmd == 'migrate':
             send(boxID, sp1[1], set_wait_ack=True)
         elif cmd == 'broadcast':
             send(boxID, sp1[1])
         elif cmd == 'crash':
             kill(boxID)
-            time.sleep(1)  # sleep for a bit so that crash is detected
+            time.sleep(4)  # sleep until the membership declares the box dead
         else:
             print("Invalid command: " + line)
 
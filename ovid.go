@@ -3,11 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 
 	agnt "github.com/TonyZhangND/GoOvid/agents"
+	paxos "github.com/TonyZhangND/GoOvid/agents/paxos_chatroom"
 	comm "github.com/TonyZhangND/GoOvid/commons"
 	conf "github.com/TonyZhangND/GoOvid/configs"
+	hist "github.com/TonyZhangND/GoOvid/history"
 	serv "github.com/TonyZhangND/GoOvid/server"
+	sup "github.com/TonyZhangND/GoOvid/supervisor"
 )
 
 // Prints the resulting map from running Parse()
@@ -19,11 +23,141 @@ func printResult(res map[comm.ProcessID]agnt.AgentInfo) {
 	fmt.Println("")
 }
 
+// Runs "ovid check-paxos [-outstanding n] <dumps...>", which checks the
+// structured dumps of the replicas of a paxos service against each other
+func checkPaxos(args []string) {
+	fs := flag.NewFlagSet("check-paxos", flag.ExitOnError)
+	outstanding := fs.Int("outstanding", 1, "Max number of requests a client has in flight")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		comm.FatalOvidErrorf("Usage: ovid check-paxos [-outstanding n] <dumps...>\n")
+	}
+	dumps := make([]*paxos.Dump, 0, fs.NArg())
+	for _, path := range fs.Args() {
+		d, err := paxos.ReadDump(path)
+		if err != nil {
+			comm.FatalOvidErrorf("%v\n", err)
+		}
+		dumps = append(dumps, d)
+	}
+	errs := paxos.CheckDumps(dumps, *outstanding)
+	if len(errs) == 0 {
+		fmt.Println("All good :)")
+		return
+	}
+	for _, e := range errs {
+		fmt.Println(e)
+	}
+	os.Exit(1)
+}
+
+// Runs "ovid check-history -model <kvs|log> <histories...>", which checks that the
+// histories recorded by the clients of a service are linearizable
+func checkHistory(args []string) {
+	fs := flag.NewFlagSet("check-history", flag.ExitOnError)
+	modelName := fs.String("model", "log", "Model of the service, kvs or log")
+	fs.Parse(args)
+	model, ok := hist.Models[*modelName]
+	if !ok || fs.NArg() < 1 {
+		comm.FatalOvidErrorf("Usage: ovid check-history -model <kvs|log> <histories...>\n")
+	}
+	ops, err := hist.ReadHistories(fs.Args()...)
+	if err != nil {
+		comm.FatalOvidErrorf("%v\n", err)
+	}
+	ok, bad := hist.Check(model, ops)
+	if ok {
+		fmt.Printf("All good :) %d operations are linearizable\n", len(ops))
+		return
+	}
+	fmt.Printf("History is not linearizable. Operations involved:\n")
+	for _, op := range bad {
+		output := op.Output
+		if op.Pending {
+			output = "<pending>"
+		}
+		fmt.Printf("client %d [%d, %d] %s -> %s\n", op.Client, op.Call, op.Return, op.Input, output)
+	}
+	os.Exit(1)
+}
+
+// Runs "ovid gen [options] <paxos|kvs|chat>", which prints or writes the
+// configuration of a built-in topology
+func gen(args []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	out := fs.String("o", "", "Output file, stdout if empty")
+	idBase := fs.Int("id-base", 0, "Agent IDs are offsets from id-base")
+	portBase := fs.Int("port-base", 5000, "Box ports are offsets from port-base")
+	ip := fs.String("ip", "127.0.0.1", "IP address of the boxes")
+	f := fs.Int("f", 1, "paxos: number of failures tolerated")
+	clients := fs.Int("clients", 1, "paxos, kvs: number of clients")
+	mode := fs.String("mode", "script", "paxos: mode of the clients, script or manual")
+	separated := fs.Bool("separated", false, "paxos: run leaders and acceptors as separate agents")
+	script := fs.String("script", "", "paxos: scenario of the controller")
+	members := fs.Int("members", 3, "chat: number of members")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		comm.FatalOvidErrorf("Usage: ovid gen [options] <paxos|kvs|chat>\n")
+	}
+	opts := &conf.GenOptions{IDBase: *idBase, PortBase: *portBase, IP: *ip}
+	var cfg conf.Config
+	var err error
+	switch fs.Arg(0) {
+	case "paxos":
+		cfg, err = conf.GeneratePaxos(&conf.PaxosOptions{
+			F:         *f,
+			Clients:   *clients,
+			Mode:      *mode,
+			Separated: *separated,
+			Script:    *script}, opts)
+	case "kvs":
+		cfg, err = conf.GenerateKVS(*clients, opts)
+	case "chat":
+		cfg, err = conf.GenerateChat(*members, opts)
+	default:
+		comm.FatalOvidErrorf("Unknown topology %s\n", fs.Arg(0))
+	}
+	if err == nil {
+		err = cfg.Write(*out)
+	}
+	if err != nil {
+		comm.FatalOvidErrorf("%v\n", err)
+	}
+}
+
+// Runs "ovid convert <in> <out>", which converts a configuration between JSON,
+// YAML and TOML according to the file extensions
+func convert(args []string) {
+	if len(args) != 2 {
+		comm.FatalOvidErrorf("Usage: ovid convert <in.json|yaml|toml> <out.json|yaml|toml>\n")
+	}
+	if err := conf.Convert(args[0], args[1]); err != nil {
+		comm.FatalOvidErrorf("%v\n", err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert":
+			convert(os.Args[2:])
+			return
+		case "gen":
+			gen(os.Args[2:])
+			return
+		case "check-paxos":
+			checkPaxos(os.Args[2:])
+			return
+		case "check-history":
+			checkHistory(os.Args[2:])
+			return
+		}
+	}
 	// process command line arguments and parse config
 	masterPort := flag.Int("master", 0, "Local port number for master connection")
 	debugMode := flag.Bool("debug", false, "Toggles debugMode to on")
 	logMode := flag.Bool("log", false, "Toggles logMode to on")
+	join := flag.Bool("join", false, "Joins a running grid, announcing the configuration to its boxes")
 	loss := flag.Float64("loss", 0, "Rate at which a server drops inter-agent messages")
 	flag.Parse()
 	config := flag.Args()[0]
@@ -35,6 +169,11 @@ func main() {
 	}
 	agentMap := conf.Parse(config)
 	// printResult(agentMap)
+	boxes := make(map[comm.BoxID]bool)
+	for _, agent := range agentMap {
+		boxes[agent.Box] = true
+	}
+	sup.SetGrid(config, boxes)
 
 	// start only if box is valid
 	for _, agent := range agentMap {
@@ -45,7 +184,8 @@ func main() {
 			if *logMode {
 				serv.LogFile = fmt.Sprintf("tmp/box_%v.log", myBox)
 			}
-			serv.InitAndRunServer(myBox, agentMap, mp, *loss)
+			serv.Joining = *join
+			serv.InitAndRunServer(myBox, config, agentMap, mp, *loss)
 			return
 		}
 	}
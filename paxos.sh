@@ -35,11 +35,12 @@ echo "Killing all running instances and cleaning directory..."
 rm -f nohup.out
 rm tmp/box*.log
 rm tmp/replica*.output
+rm -f tmp/replica*.log
 
 echo "Generating new configuration with"
 echo "f=$f, nclients=$nclients, mode=$mode, networkloss=$loss"
 
-python3 configs/paxos_generator.py $f $nclients $mode > configs/paxos.json
+./ovid gen -f $f -clients $nclients -mode $mode -o configs/paxos.json paxos
 
 echo "Starting all boxes"
 
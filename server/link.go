@@ -2,8 +2,11 @@ package server
 
 // This file contains the definition and methods of the link object.
 // A link is a wrapper for the TCP connection between two servers.
-// It is responsible for maintaining and monitoring the health of the
-// connection.
+// It carries the messages between the servers. The box that dials a link
+// introduces itself with a "hello <box>" line. A link does not detect failures:
+// whether a box is alive is up to the membership protocol (see membership.go),
+// which a link that fails only has probe the box at once. A link closes when its
+// connection fails, or when the membership declares its box dead.
 
 import (
 	"bufio"
@@ -21,6 +24,7 @@ type link struct {
 	conn          net.Conn
 	other         c.BoxID     // who's on the other end of the line. "" if unknown
 	isActive      bool        // loop condition for the link's routines
+	dialed        bool        // true iff I dialed the connection
 	serverOutChan chan string // used to stream messages to main server loop
 }
 
@@ -30,10 +34,14 @@ func newLink(c net.Conn, sOutChan chan string) *link {
 	return l
 }
 
-// Constructor for link where other party is known
+// Constructor for link where other party is known, i.e. that I dialed.
+// Returns nil if the link is refused
 func newLinkKnownOther(c net.Conn, bid c.BoxID, sOutChan chan string) *link {
-	l := &link{conn: c, other: bid, isActive: true, serverOutChan: sOutChan}
-	linkMgr.markAsUp(bid, l)
+	l := &link{conn: c, other: bid, isActive: true, dialed: true, serverOutChan: sOutChan}
+	if !linkMgr.markAsUp(bid, l) {
+		c.Close()
+		return nil
+	}
 	return l
 }
 
@@ -46,7 +54,7 @@ func (l *link) close() {
 	if string(l.other) == "" {
 		return
 	}
-	linkMgr.markAsDown(c.BoxID(l.other))
+	linkMgr.markAsDown(c.BoxID(l.other), l)
 	l.conn.Close()
 }
 
@@ -60,21 +68,14 @@ func (l *link) send(s string) {
 	}
 }
 
-// Begins sending pings into l.conn channel
-func (l *link) runPinger() {
-	for l.isActive {
-		ping := fmt.Sprintf("ping %v\n", myBoxID)
-		l.send(ping)
-		time.Sleep(pingInterval)
-	}
-}
-
-// Processes a ping received from the net.Conn channel
-func (l *link) doRcvPing(s string) {
+// Processes a hello received from the net.Conn channel
+func (l *link) doRcvHello(s string) {
 	if string(l.other) == "" {
 		sender := c.ParseBoxAddr(s)
 		l.other = sender
-		linkMgr.markAsUp(sender, l)
+		if !linkMgr.markAsUp(sender, l) {
+			l.close()
+		}
 	}
 }
 
@@ -82,7 +83,9 @@ func (l *link) doRcvPing(s string) {
 func (l *link) handleConnection() {
 	defer l.close()
 	l.isActive = true
-	go l.runPinger()
+	if l.dialed {
+		l.send(fmt.Sprintf("hello %v\n", myBoxID))
+	}
 	debugPrintf("Serving %s\n", l.conn.RemoteAddr().String())
 	connReader := bufio.NewReader(l.conn)
 	inChan := make(chan string)
@@ -100,19 +103,22 @@ func (l *link) handleConnection() {
 		}
 	}()
 	for l.isActive {
-		// read from inChan, or timeout if no heartbeat received
+		// read from inChan, or timeout if the other box never said hello
 		select {
 		case data := <-inChan:
 			dataSlice := strings.SplitN(strings.TrimSpace(data), " ", 2)
 			header := strings.TrimSpace(dataSlice[0])
 			payload := strings.TrimSpace(dataSlice[1])
 			switch header {
-			case "ping":
+			case "hello":
 				// payload is the box, e.g "127.0.0.1:5000"
-				l.doRcvPing(payload)
+				l.doRcvHello(payload)
 			case "chatroom":
 				// data is of format "chatroom <sender box> <msg>"
 				l.serverOutChan <- strings.TrimSpace(data)
+			case "reload", "prepare", "prepared", "migrate", "migrated", "moved", "abort":
+				// data is a control message of format "<header> <sender box> ..."
+				l.serverOutChan <- strings.TrimSpace(data)
 			case "msg":
 				// data is of format "<senderID> <destID> <destPort> <msg>"
 				l.serverOutChan <- payload
@@ -120,6 +126,9 @@ func (l *link) handleConnection() {
 				debugPrintf("Invalid msg %v\n", header)
 			}
 		case <-time.After(pingInterval * 2):
+			if l.other != "" {
+				continue
+			}
 			l.close()
 			return
 		}
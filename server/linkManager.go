@@ -20,14 +20,20 @@ import (
 // to a link object. It is initialized as lm[p]=nil for all known
 // processes p. For each process p != myPhysId, when a link l is
 // established with it, we mark lm[p] = l.
+// A box that is not known yet, e.g. a box joining the grid, becomes known when
+// it establishes a link, or when a reload of the configuration adds it.
 // It also maintains the connection with the master program
 // Note: always lm[myPhysId] = nil, since a server does not need a link
 // with itself.
 type linkManager struct {
 	manager       map[c.BoxID]*link
-	masterConn    net.Conn    // connection with the master program
-	serverOutChan chan string //used to stream inter-server messages to main server loop
-	masterOutChan chan string // used to stream master messages to main server loop
+	removed       map[c.BoxID]time.Time // boxes removed from the grid, and when
+	announced     map[c.BoxID]bool      // boxes I announced my join to
+	joining       bool                  // true until I announced my join to every box
+	leaving       bool                  // true iff I am removed from the grid
+	masterConn    net.Conn              // connection with the master program
+	serverOutChan chan string           //used to stream inter-server messages to main server loop
+	masterOutChan chan string           // used to stream master messages to main server loop
 	sync.RWMutex
 }
 
@@ -43,50 +49,127 @@ func newLinkManager(knownBoxes []c.BoxID,
 	}
 	return &linkManager{
 		manager:       t,
+		removed:       make(map[c.BoxID]time.Time),
+		announced:     make(map[c.BoxID]bool),
+		joining:       Joining,
 		serverOutChan: sOutChan,
 		masterOutChan: mstrOutChan}
 }
 
-// Marks a box as down in lm and de-registers its link object
-func (lm *linkManager) markAsDown(bid c.BoxID) {
-	lm.RLock()
-	link, ok := lm.manager[bid]
-	if link == nil {
-		defer lm.RUnlock()
-		return
-	}
-	lm.RUnlock()
-	if !ok {
-		fatalServerErrorf("Process %v does not exist in failure detector\n", bid)
+// Marks a box as down in lm and de-registers its link object l, unless another
+// link with the box replaced it. Whether the box is alive is up to the
+// membership, which probes it at once, since it may have failed
+func (lm *linkManager) markAsDown(bid c.BoxID, l *link) {
+	lm.Lock()
+	defer lm.Unlock()
+	if lm.manager[bid] == l {
+		lm.manager[bid] = nil
+		go members.probe(bid)
 	}
+}
+
+// Marks a box as up in lm and registers its link object handler. Returns false
+// if handler must be closed instead, i.e. if bid was just removed from the grid,
+// if I am leaving the grid, or if handler duplicates a link that takes precedence
+func (lm *linkManager) markAsUp(bid c.BoxID, handler *link) bool {
 	lm.Lock()
-	lm.manager[bid] = nil
+	if t, ok := lm.removed[bid]; (ok && time.Since(t) < rejoinDelay) || lm.leaving {
+		lm.Unlock()
+		return false
+	}
+	old := lm.manager[bid]
+	if old != nil && bid != myBoxID {
+		// Both boxes dialed, which happens when one is joining. Of the two
+		// links, both boxes keep the one dialed by the greater box
+		if handler.dialed != (myBoxID > bid) {
+			lm.Unlock()
+			return false
+		}
+		debugPrintf("Replacing duplicate link to %v\n", bid)
+	}
+	if _, ok := lm.manager[bid]; !ok {
+		debugPrintf("Box %v joins the grid\n", bid)
+	}
+	lm.manager[bid] = handler
+	announce := lm.joining && !lm.announced[bid]
+	lm.announced[bid] = true
+	if announce && lm.knowsMe() {
+		debugPrintf("Joined the grid\n")
+		lm.joining = false
+	}
 	lm.Unlock()
+	if old != nil && bid != myBoxID {
+		old.close()
+	}
+	if announce {
+		// announce my join, by having the box reload my configuration
+		handler.send(runningReloadMsg() + "\n")
+	}
+	return true
+}
+
+// Returns true iff I announced my join to every box of the grid. Caller holds lm
+func (lm *linkManager) knowsMe() bool {
+	for bid := range lm.manager {
+		if bid != myBoxID && !lm.announced[bid] {
+			return false
+		}
+	}
+	return true
 }
 
-// Marks a box as up in lm and registers its link object
-func (lm *linkManager) markAsUp(bid c.BoxID, handler *link) {
+// Returns true iff I am joining the grid
+func (lm *linkManager) isJoining() bool {
 	lm.RLock()
-	link, ok := lm.manager[bid]
-	if link != nil && bid != myBoxID {
-		fatalServerErrorf("Link to %v already established!\n", bid)
+	defer lm.RUnlock()
+	return lm.joining
+}
+
+// Adds box bid to lm, if not known yet
+func (lm *linkManager) addBox(bid c.BoxID) {
+	lm.Lock()
+	defer lm.Unlock()
+	delete(lm.removed, bid)
+	if _, ok := lm.manager[bid]; !ok && bid != myBoxID {
+		lm.manager[bid] = nil
+	}
+}
+
+// Removes box bid from lm, and closes the link with it. Links that bid
+// establishes within rejoinDelay are refused, since it is draining
+func (lm *linkManager) removeBox(bid c.BoxID) {
+	lm.Lock()
+	link := lm.manager[bid]
+	delete(lm.manager, bid)
+	lm.removed[bid] = time.Now()
+	lm.Unlock()
+	if link != nil {
+		link.close()
 	}
+}
+
+// Closes the link with box bid, which the membership declared dead
+func (lm *linkManager) markAsDead(bid c.BoxID) {
+	lm.RLock()
+	link := lm.manager[bid]
 	lm.RUnlock()
-	if !ok {
-		fatalServerErrorf("Process %v does not exist in failure detector\n", bid)
+	if link != nil {
+		link.close()
 	}
+}
+
+// Stops establishing links, since I am leaving the grid
+func (lm *linkManager) leave() {
 	lm.Lock()
-	lm.manager[bid] = handler
+	lm.leaving = true
 	lm.Unlock()
 }
 
-// Returns true iff box bid is up in lm
+// Returns true iff box bid is up in lm, i.e. has a link with me. Whether the box
+// is alive is up to the membership
 func (lm *linkManager) isUp(bid c.BoxID) bool {
 	lm.RLock()
-	link, ok := lm.manager[bid]
-	if !ok {
-		fatalServerErrorf("Process %v does not exist in failure detector\n", bid)
-	}
+	link := lm.manager[bid]
 	defer lm.RUnlock()
 	return link != nil
 }
@@ -147,6 +230,29 @@ func (lm *linkManager) broadcast(msg string) {
 	lm.RUnlock()
 }
 
+// Sends msg, a control message of format "<header> <my box> ...", such as a
+// reload, to all other boxes that are up
+func (lm *linkManager) broadcastControl(msg string) {
+	s := msg + "\n"
+	lm.RLock()
+	for _, link := range lm.manager {
+		if link != nil {
+			link.send(s)
+		}
+	}
+	lm.RUnlock()
+}
+
+// Sends msg, a control message of format "<header> <my box> ...", to destBox,
+// given that destBox is up
+func (lm *linkManager) sendControl(destBox c.BoxID, msg string) {
+	lm.RLock()
+	defer lm.RUnlock()
+	if link := lm.manager[destBox]; link != nil {
+		link.send(msg + "\n")
+	}
+}
+
 // Sends msg to destBox, given that destBox is up
 // Applies Ovid message format and headers
 func (lm *linkManager) send(destBox c.BoxID, msg string) {
@@ -175,13 +281,16 @@ func (lm *linkManager) dialForConnections() {
 	for shouldRun {
 		down := linkMgr.getAllDown()
 		for _, bid := range down {
-			if bid < myBoxID {
+			// a joining box dials every box, since the boxes of the grid do not
+			// know it yet
+			if bid < myBoxID || lm.isJoining() {
 				// conviniently, the bid is the tcp addr
 				c, err := net.DialTimeout("tcp", string(bid),
 					20*time.Millisecond)
 				if err == nil {
-					l := newLinkKnownOther(c, bid, lm.serverOutChan)
-					go l.handleConnection()
+					if l := newLinkKnownOther(c, bid, lm.serverOutChan); l != nil {
+						go l.handleConnection()
+					}
 				}
 			}
 		}
@@ -0,0 +1,496 @@
+package server
+
+// This file contains the membership of the grid, i.e. the boxes that are alive,
+// maintained by a SWIM-style protocol over UDP, on the port of each box.
+// Every probeInterval, a box probes the next member of a shuffled round of the
+// members with a "ping", which the member answers with an "ack". If no ack comes
+// within probeTimeout, the box has indirectProbes other members probe the member
+// with a "pingreq", and relay its ack. If no ack comes within probeInterval, the
+// box suspects the member, and declares it dead if the member does not refute the
+// suspicion within suspicionTimeout. A member refutes a suspicion by increasing
+// its incarnation number, which starts at the time the box starts, so that a
+// restarted box supersedes its previous incarnation. A box that starts probes
+// every member at once, so that it joins without waiting for their rounds.
+// Updates of the membership piggyback on pings and acks. An update of a member
+// supersedes another if it has a greater incarnation number, or the same one and
+// a worse status, where alive < suspect < dead.
+// A message is a line "<kind> <seq> <sender> <sender incarnation> [<target>]
+// [<update>...]", where an update is "<status>/<box>/<incarnation>".
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+const (
+	probeInterval    = pingInterval           // protocol period
+	probeTimeout     = 200 * time.Millisecond // time to wait for a direct ack
+	suspicionTimeout = 4 * probeInterval      // time for a suspect to refute
+	indirectProbes   = 3                      // members asked to probe on my behalf
+	maxPiggyback     = 8                      // maximum number of updates per message
+	gossipFactor     = 3                      // times log(n) that an update is sent
+)
+
+// Statuses of a member
+const (
+	statusAlive   = "alive"
+	statusSuspect = "suspect"
+	statusDead    = "dead"
+)
+
+// Severity of each status, i.e. which status wins at the same incarnation
+var statusRank = map[string]int{statusAlive: 0, statusSuspect: 1, statusDead: 2}
+
+// A member of the grid, as I see it
+type member struct {
+	status string    // alive, suspect or dead
+	inc    int64     // incarnation number of status
+	since  time.Time // when the member became suspect
+}
+
+// An update of the membership that I disseminate
+type update struct {
+	status string
+	inc    int64
+	sent   int // number of messages that carried the update
+}
+
+// A ping that I send on behalf of another box, i.e. for a pingreq
+type relay struct {
+	origin c.BoxID   // box that asked for the ping
+	seq    uint64    // sequence number of the pingreq
+	since  time.Time // when I sent the ping
+}
+
+// A membership ms tracks the status of every member of the grid other than me
+type membership struct {
+	conn        *net.UDPConn
+	members     map[c.BoxID]*member
+	removed     map[c.BoxID]time.Time // boxes removed from the grid, and when
+	inc         int64                 // my incarnation number
+	seq         uint64                // last sequence number I used
+	acks        map[uint64]chan bool  // my probes waiting for an ack
+	relays      map[uint64]relay      // pings I send on behalf of other boxes
+	updates     map[c.BoxID]*update   // updates that I disseminate
+	round       []c.BoxID             // members left to probe in this round
+	subscribers []func(bid c.BoxID, up bool)
+	leaving     bool // true iff I am removed from the grid
+	sync.Mutex
+}
+
+// Constructor for membership
+// Members are dead until I hear from them
+func newMembership(knownBoxes []c.BoxID) *membership {
+	ms := &membership{
+		members: make(map[c.BoxID]*member),
+		removed: make(map[c.BoxID]time.Time),
+		inc:     time.Now().UnixNano(),
+		acks:    make(map[uint64]chan bool),
+		relays:  make(map[uint64]relay),
+		updates: make(map[c.BoxID]*update)}
+	for _, bid := range knownBoxes {
+		if bid != myBoxID {
+			ms.members[bid] = &member{status: statusDead}
+		}
+	}
+	ms.updates[myBoxID] = &update{status: statusAlive, inc: ms.inc}
+	return ms
+}
+
+// Registers f to be called whenever a member goes up or down. A member is up
+// unless it is dead
+func (ms *membership) subscribe(f func(bid c.BoxID, up bool)) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.subscribers = append(ms.subscribers, f)
+}
+
+// Calls the subscribers on the events, i.e. the members that went up or down
+func (ms *membership) notify(events map[c.BoxID]bool) {
+	ms.Lock()
+	subscribers := ms.subscribers
+	ms.Unlock()
+	for bid, up := range events {
+		for _, f := range subscribers {
+			f(bid, up)
+		}
+	}
+}
+
+// Returns true iff update (s1, i1) supersedes update (s2, i2) of the same member
+func supersedes(s1 string, i1 int64, s2 string, i2 int64) bool {
+	return i1 > i2 || (i1 == i2 && statusRank[s1] > statusRank[s2])
+}
+
+// Queues an update of bid for dissemination. Caller holds ms
+func (ms *membership) queueLocked(bid c.BoxID, status string, inc int64) {
+	ms.updates[bid] = &update{status: status, inc: inc}
+}
+
+// Applies an update of bid, and records in events whether bid went up or down.
+// Caller holds ms
+func (ms *membership) applyLocked(bid c.BoxID, status string, inc int64,
+	events map[c.BoxID]bool) {
+	if bid == myBoxID {
+		if status != statusAlive && inc >= ms.inc && !ms.leaving {
+			// refute the suspicion
+			ms.inc = inc + 1
+			ms.queueLocked(myBoxID, statusAlive, ms.inc)
+			debugPrintf("Refuting %s with incarnation %d\n", status, ms.inc)
+		}
+		return
+	}
+	if t, ok := ms.removed[bid]; ok {
+		if time.Since(t) < rejoinDelay {
+			return
+		}
+		delete(ms.removed, bid)
+	}
+	m, ok := ms.members[bid]
+	if !ok {
+		m = &member{status: statusDead}
+		ms.members[bid] = m
+	}
+	if !supersedes(status, inc, m.status, m.inc) {
+		return
+	}
+	wasUp := m.status != statusDead
+	m.status, m.inc = status, inc
+	if status == statusSuspect {
+		m.since = time.Now()
+	}
+	ms.queueLocked(bid, status, inc)
+	if up := status != statusDead; up != wasUp {
+		events[bid] = up
+	}
+}
+
+// Returns the message of the given kind, with the updates that piggyback on it.
+// Caller holds ms
+func (ms *membership) messageLocked(kind string, seq uint64, target c.BoxID, to c.BoxID) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %d %v %d", kind, seq, myBoxID, ms.inc)
+	if target != "" {
+		fmt.Fprintf(&b, " %v", target)
+	}
+	if m, ok := ms.members[to]; ok && m.status != statusAlive {
+		// tell to what I think of it, so that it may refute it
+		fmt.Fprintf(&b, " %s/%v/%d", m.status, to, m.inc)
+	}
+	limit := gossipFactor * int(math.Ceil(math.Log2(float64(len(ms.members)+2))))
+	n := 0
+	for bid, u := range ms.updates {
+		if n == maxPiggyback {
+			break
+		}
+		fmt.Fprintf(&b, " %s/%v/%d", u.status, bid, u.inc)
+		n++
+		if u.sent++; u.sent >= limit {
+			delete(ms.updates, bid)
+		}
+	}
+	return b.String()
+}
+
+// Sends msg to box bid over UDP
+func (ms *membership) sendTo(bid c.BoxID, msg string) {
+	addr, err := net.ResolveUDPAddr("udp", string(bid))
+	if err != nil {
+		debugPrintf("Cannot resolve %v: %v\n", bid, err)
+		return
+	}
+	if _, err := ms.conn.WriteToUDP([]byte(msg+"\n"), addr); err != nil {
+		debugPrintf("Membership message to %v failed: %v\n", bid, err)
+	}
+}
+
+// Handles a membership message
+func (ms *membership) handle(data string) {
+	f := strings.Fields(data)
+	if len(f) < 4 {
+		debugPrintf("Invalid membership message '%s'\n", data)
+		return
+	}
+	kind, from := f[0], c.BoxID(f[2])
+	seq, err1 := strconv.ParseUint(f[1], 10, 64)
+	inc, err2 := strconv.ParseInt(f[3], 10, 64)
+	rest := f[4:]
+	var target c.BoxID
+	if kind == "pingreq" && len(rest) > 0 {
+		target, rest = c.BoxID(rest[0]), rest[1:]
+	}
+	if err1 != nil || err2 != nil || (kind == "pingreq" && target == "") {
+		debugPrintf("Invalid membership message '%s'\n", data)
+		return
+	}
+	events := make(map[c.BoxID]bool)
+	type reply struct {
+		to  c.BoxID
+		msg string
+	}
+	var replies []reply
+	ms.Lock()
+	if ms.leaving {
+		ms.Unlock()
+		return
+	}
+	// a message from a box shows that it is alive
+	ms.applyLocked(from, statusAlive, inc, events)
+	for _, u := range rest {
+		us := strings.SplitN(u, "/", 3)
+		if len(us) != 3 {
+			continue
+		}
+		if _, ok := statusRank[us[0]]; !ok {
+			continue
+		}
+		uinc, err := strconv.ParseInt(us[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		ms.applyLocked(c.BoxID(us[1]), us[0], uinc, events)
+	}
+	switch kind {
+	case "ping":
+		replies = append(replies, reply{from, ms.messageLocked("ack", seq, "", from)})
+	case "ack":
+		if ack, ok := ms.acks[seq]; ok {
+			delete(ms.acks, seq)
+			close(ack)
+		}
+		if r, ok := ms.relays[seq]; ok {
+			delete(ms.relays, seq)
+			replies = append(replies, reply{r.origin, ms.messageLocked("ack", r.seq, "", r.origin)})
+		}
+	case "pingreq":
+		ms.seq++
+		ms.relays[ms.seq] = relay{origin: from, seq: seq, since: time.Now()}
+		replies = append(replies, reply{target, ms.messageLocked("ping", ms.seq, "", target)})
+	default:
+		debugPrintf("Invalid membership message '%s'\n", data)
+	}
+	ms.Unlock()
+	for _, r := range replies {
+		ms.sendTo(r.to, r.msg)
+	}
+	ms.notify(events)
+}
+
+// Probes box bid, and suspects it if it does not answer within probeInterval,
+// unless I heard of a new incarnation of it meanwhile. A suspect is told of the
+// suspicion, so that it may refute it
+func (ms *membership) probe(bid c.BoxID) {
+	ms.Lock()
+	if ms.leaving || ms.conn == nil {
+		// left, or not started yet
+		ms.Unlock()
+		return
+	}
+	var inc int64
+	if m, ok := ms.members[bid]; ok {
+		inc = m.inc
+	}
+	ms.seq++
+	seq := ms.seq
+	ack := make(chan bool)
+	ms.acks[seq] = ack
+	ping := ms.messageLocked("ping", seq, "", bid)
+	ms.Unlock()
+	ms.sendTo(bid, ping)
+	select {
+	case <-ack:
+		return
+	case <-time.After(probeTimeout):
+	}
+	// probe indirectly through other members
+	ms.Lock()
+	helpers := make([]c.BoxID, 0)
+	for other, m := range ms.members {
+		if other != bid && m.status == statusAlive {
+			helpers = append(helpers, other)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > indirectProbes {
+		helpers = helpers[:indirectProbes]
+	}
+	reqs := make([]string, len(helpers))
+	for i, h := range helpers {
+		reqs[i] = ms.messageLocked("pingreq", seq, bid, h)
+	}
+	ms.Unlock()
+	for i, h := range helpers {
+		ms.sendTo(h, reqs[i])
+	}
+	select {
+	case <-ack:
+		return
+	case <-time.After(probeInterval - probeTimeout):
+	}
+	ms.Lock()
+	delete(ms.acks, seq)
+	m, ok := ms.members[bid]
+	if !ok || m.status != statusAlive || m.inc != inc || ms.leaving {
+		ms.Unlock()
+		return
+	}
+	debugPrintf("Suspecting %v\n", bid)
+	m.status, m.since = statusSuspect, time.Now()
+	ms.queueLocked(bid, statusSuspect, m.inc)
+	ms.seq++
+	ping = ms.messageLocked("ping", ms.seq, "", bid)
+	ms.Unlock()
+	ms.sendTo(bid, ping)
+}
+
+// Declares dead the suspects that did not refute their suspicion in time, and
+// forgets the relays that were not acked
+func (ms *membership) expire() {
+	events := make(map[c.BoxID]bool)
+	ms.Lock()
+	for bid, m := range ms.members {
+		if m.status == statusSuspect && time.Since(m.since) > suspicionTimeout {
+			debugPrintf("Declaring %v dead\n", bid)
+			m.status = statusDead
+			ms.queueLocked(bid, statusDead, m.inc)
+			events[bid] = false
+		}
+	}
+	for seq, r := range ms.relays {
+		if time.Since(r.since) > probeInterval {
+			delete(ms.relays, seq)
+		}
+	}
+	ms.Unlock()
+	ms.notify(events)
+}
+
+// Returns the next member to probe, in a round robin over a shuffled list of
+// the members. Dead members are probed too, to find out when they come back
+func (ms *membership) nextTarget() (c.BoxID, bool) {
+	ms.Lock()
+	defer ms.Unlock()
+	for {
+		if len(ms.round) == 0 {
+			for bid := range ms.members {
+				ms.round = append(ms.round, bid)
+			}
+			if len(ms.round) == 0 {
+				return "", false
+			}
+			rand.Shuffle(len(ms.round), func(i, j int) {
+				ms.round[i], ms.round[j] = ms.round[j], ms.round[i]
+			})
+		}
+		bid := ms.round[0]
+		ms.round = ms.round[1:]
+		if _, ok := ms.members[bid]; ok {
+			return bid, true
+		}
+	}
+}
+
+// Probes a member every probeInterval
+func (ms *membership) runProber() {
+	for shouldRun {
+		start := time.Now()
+		if bid, ok := ms.nextTarget(); ok {
+			ms.probe(bid)
+		}
+		ms.expire()
+		time.Sleep(probeInterval - time.Since(start))
+	}
+}
+
+// Receives membership messages
+func (ms *membership) listen() {
+	buf := make([]byte, 65536)
+	for shouldRun {
+		n, _, err := ms.conn.ReadFromUDP(buf)
+		if err != nil {
+			debugPrintf("Membership read failed: %v\n", err)
+			continue
+		}
+		ms.handle(string(buf[:n]))
+	}
+}
+
+// Adds box bid to the members, if not known yet
+func (ms *membership) addBox(bid c.BoxID) {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.removed, bid)
+	if _, ok := ms.members[bid]; !ok && bid != myBoxID {
+		ms.members[bid] = &member{status: statusDead}
+	}
+}
+
+// Removes box bid from the members. Messages about bid within rejoinDelay are
+// ignored, since it is draining
+func (ms *membership) removeBox(bid c.BoxID) {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.members, bid)
+	delete(ms.updates, bid)
+	ms.removed[bid] = time.Now()
+}
+
+// Stops the protocol, since I am leaving the grid
+func (ms *membership) leave() {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.leaving = true
+}
+
+// Returns true iff box bid is a member that is not dead, i.e. alive or suspect
+func (ms *membership) isUp(bid c.BoxID) bool {
+	ms.Lock()
+	defer ms.Unlock()
+	m, ok := ms.members[bid]
+	return ok && m.status != statusDead
+}
+
+// Returns a slice containing the members that are alive, including me
+func (ms *membership) getAllAlive() []c.BoxID {
+	ms.Lock()
+	defer ms.Unlock()
+	result := []c.BoxID{myBoxID}
+	for bid, m := range ms.members {
+		if m.status == statusAlive {
+			result = append(result, bid)
+		}
+	}
+	return result
+}
+
+// Starts the protocol
+func (ms *membership) run() {
+	addr, err := net.ResolveUDPAddr("udp", string(myBoxID))
+	var conn *net.UDPConn
+	if err == nil {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	ms.Lock()
+	ms.conn = conn
+	go ms.listen()
+	// join: probe every member at once, so that the members that are alive
+	// learn of me without waiting for their round to reach me
+	for bid := range ms.members {
+		go ms.probe(bid)
+	}
+	ms.Unlock()
+	go ms.runProber()
+}
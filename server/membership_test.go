@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Returns the membership of box 127.0.0.1:5000 in a grid of two other boxes that
+// never answer, and the events it raises
+func testMembership(t *testing.T) (*membership, *[]string) {
+	myBoxID = "127.0.0.1:5000"
+	ms := newMembership([]c.BoxID{myBoxID, "127.0.0.1:5001", "127.0.0.1:5002"})
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Cannot listen on UDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ms.conn = conn
+	var mut sync.Mutex
+	events := make([]string, 0)
+	ms.subscribe(func(bid c.BoxID, up bool) {
+		mut.Lock()
+		defer mut.Unlock()
+		events = append(events, fmt.Sprintf("%v %v", bid, up))
+	})
+	return ms, &events
+}
+
+// Checks the status and incarnation of member bid
+func checkMember(t *testing.T, ms *membership, bid c.BoxID, status string, inc int64) {
+	t.Helper()
+	ms.Lock()
+	defer ms.Unlock()
+	m := ms.members[bid]
+	if m.status != status || m.inc != inc {
+		t.Errorf("%v is %s at %d; want %s at %d", bid, m.status, m.inc, status, inc)
+	}
+}
+
+// Checks the events raised since the last check
+func checkEvents(t *testing.T, events *[]string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(*events) != fmt.Sprint(want) {
+		t.Errorf("events %v; want %v", *events, want)
+	}
+	*events = (*events)[:0]
+}
+
+// Tests the order of updates of a member
+func TestMembership_Supersedes(t *testing.T) {
+	tests := []struct {
+		s1   string
+		i1   int64
+		s2   string
+		i2   int64
+		want bool
+	}{
+		{statusAlive, 2, statusDead, 1, true},
+		{statusDead, 1, statusAlive, 2, false},
+		{statusSuspect, 1, statusAlive, 1, true},
+		{statusDead, 1, statusSuspect, 1, true},
+		{statusAlive, 1, statusSuspect, 1, false},
+		{statusAlive, 1, statusAlive, 1, false},
+	}
+	for _, test := range tests {
+		if got := supersedes(test.s1, test.i1, test.s2, test.i2); got != test.want {
+			t.Errorf("supersedes(%s/%d, %s/%d) = %v", test.s1, test.i1, test.s2, test.i2, got)
+		}
+	}
+}
+
+// Tests that an unanswered probe leads to suspicion, and an expired suspicion to
+// death, unless the member refutes it
+func TestMembership_Suspicion(t *testing.T) {
+	ms, events := testMembership(t)
+	ms.handle("ping 1 127.0.0.1:5001 5")
+	ms.handle("ping 1 127.0.0.1:5002 7")
+	checkMember(t, ms, "127.0.0.1:5001", statusAlive, 5)
+	checkEvents(t, events, "127.0.0.1:5001 true", "127.0.0.1:5002 true")
+
+	ms.probe("127.0.0.1:5001")
+	ms.probe("127.0.0.1:5002")
+	checkMember(t, ms, "127.0.0.1:5001", statusSuspect, 5)
+	checkMember(t, ms, "127.0.0.1:5002", statusSuspect, 7)
+	checkEvents(t, events)
+
+	// an alive update of the same incarnation does not refute the suspicion
+	ms.handle("ack 9 127.0.0.1:5002 7 alive/127.0.0.1:5001/5")
+	checkMember(t, ms, "127.0.0.1:5001", statusSuspect, 5)
+	// but one of a greater incarnation does
+	ms.handle("ack 9 127.0.0.1:5002 7 alive/127.0.0.1:5001/6")
+	checkMember(t, ms, "127.0.0.1:5001", statusAlive, 6)
+
+	ms.Lock()
+	ms.members["127.0.0.1:5001"].since = time.Now().Add(-2 * suspicionTimeout)
+	ms.members["127.0.0.1:5002"].since = time.Now().Add(-2 * suspicionTimeout)
+	ms.Unlock()
+	ms.expire()
+	checkMember(t, ms, "127.0.0.1:5001", statusAlive, 6)
+	checkMember(t, ms, "127.0.0.1:5002", statusDead, 7)
+	checkEvents(t, events, "127.0.0.1:5002 false")
+
+	// a stale update does not revive a dead member
+	ms.handle("ack 10 127.0.0.1:5001 6 alive/127.0.0.1:5002/6")
+	checkMember(t, ms, "127.0.0.1:5002", statusDead, 7)
+	checkEvents(t, events)
+	// a restarted member does
+	ms.handle("ping 1 127.0.0.1:5002 8")
+	checkMember(t, ms, "127.0.0.1:5002", statusAlive, 8)
+	checkEvents(t, events, "127.0.0.1:5002 true")
+}
+
+// Tests that a box refutes a suspicion of itself with a greater incarnation
+func TestMembership_Refutation(t *testing.T) {
+	ms, _ := testMembership(t)
+	ms.Lock()
+	inc := ms.inc
+	ms.Unlock()
+	// a suspicion of an old incarnation is already refuted
+	ms.handle(fmt.Sprintf("ping 1 127.0.0.1:5001 5 suspect/%v/%d", myBoxID, inc-1))
+	ms.Lock()
+	if ms.inc != inc {
+		t.Errorf("incarnation %d after stale suspicion; want %d", ms.inc, inc)
+	}
+	ms.Unlock()
+
+	ms.handle(fmt.Sprintf("ping 2 127.0.0.1:5001 5 suspect/%v/%d", myBoxID, inc))
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.inc != inc+1 {
+		t.Errorf("incarnation %d after suspicion; want %d", ms.inc, inc+1)
+	}
+	if u := ms.updates[myBoxID]; u == nil || u.status != statusAlive || u.inc != inc+1 {
+		t.Errorf("refutation %v not disseminated", u)
+	}
+}
+
+// Tests that a probe that starts before a member joins does not suspect it
+func TestMembership_ProbeJoin(t *testing.T) {
+	ms, events := testMembership(t)
+	done := make(chan bool)
+	go func() {
+		ms.probe("127.0.0.1:5001")
+		close(done)
+	}()
+	// wait for the ping of the probe
+	for n := 0; n == 0; time.Sleep(time.Millisecond) {
+		ms.Lock()
+		n = len(ms.acks)
+		ms.Unlock()
+	}
+	ms.handle("ping 1 127.0.0.1:5001 5")
+	<-done
+	checkMember(t, ms, "127.0.0.1:5001", statusAlive, 5)
+	checkEvents(t, events, "127.0.0.1:5001 true")
+}
@@ -0,0 +1,320 @@
+package server
+
+// This file contains the live migration of agents between boxes.
+// The master command "migrate <pid> <box>" moves agent pid, which runs on the box
+// receiving the command, to box, which must be up. The agent must implement
+// agents.Migratable. The source box buffers the messages to the agent instead of
+// delivering them, waits for the deliveries in progress, halts the agent and sends
+// its snapshot to the destination box. The destination box creates the agent from
+// the running configuration, restores the snapshot and runs it. The source box
+// then routes the agent to the destination box, forwards the buffered messages
+// there, and has every other box route the agent there too. Until a box learns of
+// the move, its messages to the agent go to the source box, which forwards them.
+// Thus no message is lost, although a forwarded message may arrive after a message
+// sent later by another box. If the destination box does not create the agent
+// within migrateTimeout, the source box restores the agent itself.
+// A migration changes the running configuration only. A reload that gives the
+// agent the box it migrated from keeps it on its new box.
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	a "github.com/TonyZhangND/GoOvid/agents"
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+const migrateTimeout = 5 * time.Second // maximum time to create an agent on its new box
+
+// A message to an agent that is moving, or moved, from this box
+type pending struct {
+	sender c.ProcessID
+	port   c.PortNum
+	data   string
+}
+
+// A migration of an agent from this box
+type migration struct {
+	dest   c.BoxID    // box the agent moved to, "" while the agent moves
+	buffer []pending  // messages received while the agent moves
+	done   chan error // result of the creation of the agent on its new box
+}
+
+var (
+	agentsMut  *sync.Mutex                // mutex for myAgents, inflight and migrations
+	agentsCond *sync.Cond                 // signaled when a delivery completes
+	inflight   map[c.ProcessID]int        // number of deliveries in progress per agent
+	migrations map[c.ProcessID]*migration // agents moving, or moved, from this box
+	movedFrom  map[c.ProcessID]c.BoxID    // box of each migrated agent in the configuration file, under configMut
+)
+
+// Returns a copy of myAgents
+func localAgents() map[c.ProcessID]*a.Agent {
+	agentsMut.Lock()
+	defer agentsMut.Unlock()
+	res := make(map[c.ProcessID]*a.Agent, len(myAgents))
+	for pid, agent := range myAgents {
+		res[pid] = agent
+	}
+	return res
+}
+
+// Delivers msg from senderID to my agent pid, on destPort. Buffers msg if the agent
+// is moving, and forwards it if the agent moved
+func deliver(senderID, pid c.ProcessID, destPort c.PortNum, msg string) {
+	agentsMut.Lock()
+	if m, ok := migrations[pid]; ok {
+		if m.dest == "" {
+			m.buffer = append(m.buffer, pending{senderID, destPort, msg})
+		} else {
+			linkMgr.send(m.dest, fmt.Sprintf("%d %d %d %s", senderID, pid, destPort, msg))
+		}
+		agentsMut.Unlock()
+		return
+	}
+	agent, ok := myAgents[pid]
+	if !ok {
+		// the sender does not know the latest configuration yet
+		agentsMut.Unlock()
+		debugPrintf("Dropping message '%s' to agent %d, which is not on this box\n", msg, pid)
+		return
+	}
+	inflight[pid]++
+	agentsMut.Unlock()
+	(*agent).Deliver(msg, destPort)
+	agentsMut.Lock()
+	inflight[pid]--
+	agentsCond.Broadcast()
+	agentsMut.Unlock()
+}
+
+// Routes agent pid to box to in the running configuration, if it runs on box from
+func setBox(pid c.ProcessID, from, to c.BoxID) {
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+	configMut.Lock()
+	defer configMut.Unlock()
+	info, ok := gridConfig[pid]
+	if !ok || info.Box != from {
+		return
+	}
+	moved := *info
+	moved.Box = to
+	gridConfig[pid] = &moved
+	if home, ok := movedFrom[pid]; !ok {
+		movedFrom[pid] = from
+	} else if home == to {
+		delete(movedFrom, pid)
+	}
+}
+
+// Creates my agent pid from the running configuration, restores state into it and
+// runs it. The messages buffered for the agent are delivered before any other
+func startAgent(pid c.ProcessID, state string) error {
+	agentsMut.Lock()
+	_, ok := myAgents[pid]
+	agentsMut.Unlock()
+	if ok {
+		return fmt.Errorf("agent %d already runs on box %s", pid, myBoxID)
+	}
+	agent := initAgent(pid)
+	mig, ok := (*agent).(a.Migratable)
+	if !ok {
+		return fmt.Errorf("agent %d cannot migrate", pid)
+	}
+	mig.Restore(state)
+	go (*agent).Run()
+	agentsMut.Lock()
+	m, ok := migrations[pid]
+	for ok && len(m.buffer) > 0 {
+		// deliver without holding agentsMut, since the agent may send
+		buffer := m.buffer
+		m.buffer = nil
+		agentsMut.Unlock()
+		for _, msg := range buffer {
+			(*agent).Deliver(msg.data, msg.port)
+		}
+		agentsMut.Lock()
+	}
+	delete(migrations, pid)
+	myAgents[pid] = agent
+	agentsMut.Unlock()
+	// tell the agent which of its peers are up
+	for _, bid := range members.getAllAlive() {
+		if bid != myBoxID {
+			notifyPeerStatus(pid, agent, bid, true)
+		}
+	}
+	return nil
+}
+
+// Moves my agent pid to box dest
+func migrate(pid c.ProcessID, dest c.BoxID) error {
+	if dest == myBoxID {
+		return fmt.Errorf("agent %d already runs on box %s", pid, dest)
+	}
+	if !linkMgr.isUp(dest) {
+		return fmt.Errorf("box %s is not up", dest)
+	}
+	agentsMut.Lock()
+	agent, ok := myAgents[pid]
+	if !ok {
+		agentsMut.Unlock()
+		return fmt.Errorf("agent %d does not run on box %s", pid, myBoxID)
+	}
+	mig, ok := (*agent).(a.Migratable)
+	if !ok {
+		agentsMut.Unlock()
+		return fmt.Errorf("agent %d cannot migrate", pid)
+	}
+	m := &migration{done: make(chan error, 1)}
+	migrations[pid] = m
+	delete(myAgents, pid)
+	for inflight[pid] > 0 {
+		agentsCond.Wait()
+	}
+	agentsMut.Unlock()
+	(*agent).Halt()
+	state := mig.Snapshot()
+	debugPrintf("Migrating agent %d to box %s\n", pid, dest)
+	linkMgr.sendControl(dest, fmt.Sprintf("migrate %v %d %s",
+		myBoxID, pid, base64.StdEncoding.EncodeToString([]byte(state))))
+	var err error
+	select {
+	case err = <-m.done:
+	case <-time.After(migrateTimeout):
+		err = fmt.Errorf("box %s did not create agent %d", dest, pid)
+		linkMgr.sendControl(dest, fmt.Sprintf("abort %v %d", myBoxID, pid))
+	}
+	if err != nil {
+		// take the agent back
+		if rerr := startAgent(pid, state); rerr != nil {
+			fatalServerErrorf("Cannot restore agent %d: %v\n", pid, rerr)
+		}
+		return err
+	}
+	setBox(pid, myBoxID, dest)
+	agentsMut.Lock()
+	m.dest = dest
+	for _, msg := range m.buffer {
+		linkMgr.send(dest, fmt.Sprintf("%d %d %d %s", msg.sender, pid, msg.port, msg.data))
+	}
+	m.buffer = nil
+	agentsMut.Unlock()
+	linkMgr.broadcastControl(fmt.Sprintf("moved %v %d %s", myBoxID, pid, dest))
+	debugPrintf("Migrated agent %d to box %s\n", pid, dest)
+	return nil
+}
+
+// Handles a control message of a migration from box src, i.e.
+//
+//	"migrate <src> <pid> <snapshot>"    create agent pid from its snapshot
+//	"migrated <src> <pid> ok"           src created agent pid
+//	"migrated <src> <pid> failed <err>" src could not create agent pid
+//	"abort <src> <pid>"                 src took agent pid back
+//	"moved <src> <pid> <dest>"          agent pid moved from src to dest
+func handleMigrationMsg(data string) {
+	dataSlice := strings.SplitN(strings.TrimSpace(data), " ", 4)
+	if len(dataSlice) < 3 {
+		debugPrintf("Invalid migration message '%s'\n", data)
+		return
+	}
+	header, src := dataSlice[0], c.BoxID(dataSlice[1])
+	id, err := strconv.ParseUint(dataSlice[2], 10, 16)
+	checkFatalServerErrorf(err, "Cannot parse agent of migration message '%s'\n", data)
+	pid := c.ProcessID(id)
+	arg := "" // the snapshot of a migrate is empty if the agent has no state
+	if len(dataSlice) == 4 {
+		arg = dataSlice[3]
+	}
+	switch header {
+	case "migrate":
+		reply := fmt.Sprintf("migrated %v %d ok", myBoxID, pid)
+		if err := doMigrateIn(src, pid, arg); err != nil {
+			reply = fmt.Sprintf("migrated %v %d failed %v", myBoxID, pid, err)
+		}
+		linkMgr.sendControl(src, reply)
+	case "migrated":
+		var err error
+		if arg != "ok" {
+			err = fmt.Errorf("box %s: %s", src, strings.TrimPrefix(arg, "failed "))
+		}
+		agentsMut.Lock()
+		if m, ok := migrations[pid]; ok && m.dest == "" {
+			select {
+			case m.done <- err:
+			default:
+			}
+		}
+		agentsMut.Unlock()
+	case "abort":
+		if box, _ := boxOf(pid); box != src {
+			return
+		}
+		agentsMut.Lock()
+		agent, ok := myAgents[pid]
+		delete(myAgents, pid)
+		for inflight[pid] > 0 {
+			agentsCond.Wait()
+		}
+		agentsMut.Unlock()
+		if ok {
+			(*agent).Halt()
+		}
+	case "moved":
+		dest := c.BoxID(arg)
+		setBox(pid, src, dest)
+		agentsMut.Lock()
+		if m, ok := migrations[pid]; ok && m.dest != "" {
+			// forward to where the agent is now
+			m.dest = dest
+		}
+		agentsMut.Unlock()
+	}
+}
+
+// Creates agent pid, which moves from box src, from its encoded snapshot
+func doMigrateIn(src c.BoxID, pid c.ProcessID, encoded string) error {
+	if box, ok := boxOf(pid); !ok || box != src {
+		return fmt.Errorf("agent %d does not run on box %s", pid, src)
+	}
+	state, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("cannot decode snapshot of agent %d", pid)
+	}
+	return startAgent(pid, string(state))
+}
+
+// Returns the box of agent pid in the running configuration
+func boxOf(pid c.ProcessID) (c.BoxID, bool) {
+	configMut.RLock()
+	defer configMut.RUnlock()
+	info, ok := gridConfig[pid]
+	if !ok {
+		return "", false
+	}
+	return info.Box, true
+}
+
+// Responds to a "migrate <pid> <box>" command from the master
+func doMigrate(args string) {
+	argSlice := strings.Fields(args)
+	if len(argSlice) != 2 {
+		linkMgr.sendToMaster("migrated failed usage: migrate <pid> <box>")
+		return
+	}
+	id, err := strconv.ParseUint(argSlice[0], 10, 16)
+	if err != nil {
+		linkMgr.sendToMaster(fmt.Sprintf("migrated failed invalid agent %s", argSlice[0]))
+		return
+	}
+	if err := migrate(c.ProcessID(id), c.BoxID(argSlice[1])); err != nil {
+		linkMgr.sendToMaster(fmt.Sprintf("migrated failed %v", err))
+		return
+	}
+	linkMgr.sendToMaster("migrated ok")
+}
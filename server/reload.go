@@ -0,0 +1,429 @@
+package server
+
+// This file contains the hot reload of the configuration of a running grid.
+// A reload is triggered on a box by the master command "reload <path>", or by a
+// SIGHUP, which reloads the configuration file the box was started with. The box
+// validates the new configuration against the running one, and has every other
+// box that is up validate it too, with a "prepare" message that each box answers
+// with a "prepared" message. If a box rejects the configuration, or does not
+// answer within prepareTimeout, no box swaps it in and the reload fails. Otherwise
+// the box swaps it in, and forwards the contents of the configuration file to the
+// boxes that are up, which do the same. A box that is down when the reload
+// happens comes back with the configuration it was started with. The supervisor
+// of a box starts boxes with the configuration the box runs.
+// A new configuration may change the routes and the attributes of agents, and add
+// or remove whole boxes with their agents. Every agent of a box that stays keeps
+// its type and its box, so that a message in flight still finds its destination,
+// and an agent whose attributes change must implement agents.Reconfigurable. An
+// agent that migrated stays on the box it migrated to if the new configuration
+// gives it the box it migrated from, e.g. when a box reloads the file it was
+// started with.
+// A box joins a running grid by starting with a configuration that includes it,
+// with the -join flag. It then dials every box, and has it reload its
+// configuration, until every box of the grid knows it. A box that a reload
+// removes keeps delivering messages to its agents until every other box dropped
+// its link with it, or for drainTimeout at most, and then halts its agents and
+// exits.
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	a "github.com/TonyZhangND/GoOvid/agents"
+	c "github.com/TonyZhangND/GoOvid/commons"
+	conf "github.com/TonyZhangND/GoOvid/configs"
+	sup "github.com/TonyZhangND/GoOvid/supervisor"
+)
+
+const (
+	drainTimeout   = 5 * time.Second  // maximum time a removed box drains
+	rejoinDelay    = 10 * time.Second // time during which a removed box may not link
+	prepareTimeout = 3 * time.Second  // maximum time for the boxes to validate a reload
+)
+
+// A validation of a reload of mine by the other boxes
+type preparation struct {
+	waiting map[c.BoxID]bool // boxes that have yet to answer
+	done    chan error       // nil once every box accepted, or the first rejection
+}
+
+var (
+	configFile   string        // path to the configuration that the box started with
+	configData   []byte        // contents of the file of the running configuration
+	configFormat string        // format of configData
+	configMut    *sync.RWMutex // mutex for gridConfig, configData and configFormat
+	reloadMut    *sync.Mutex   // serializes reloads
+)
+
+var (
+	prepareMut   *sync.Mutex             // mutex for preparations and prepareSeq
+	preparations map[uint64]*preparation // validations of my reloads in progress
+	prepareSeq   uint64                  // id of my last validation
+)
+
+// Returns the control message "reload <my box> <format> <base64 of dat>", which
+// has a box reload dat, the contents of a configuration file in format
+func reloadMsg(dat []byte, format string) string {
+	return fmt.Sprintf("reload %v %s %s", myBoxID, format, base64.StdEncoding.EncodeToString(dat))
+}
+
+// Reads the contents of my configuration file into configData
+func readConfigData() {
+	var err error
+	configFormat, err = conf.Format(configFile)
+	checkFatalServerErrorf(err, "Cannot read configuration %s: %v\n", configFile, err)
+	configData, err = ioutil.ReadFile(configFile)
+	checkFatalServerErrorf(err, "Cannot read configuration %s: %v\n", configFile, err)
+}
+
+// Returns the control message that has a box reload the running configuration
+func runningReloadMsg() string {
+	configMut.RLock()
+	defer configMut.RUnlock()
+	return reloadMsg(configData, configFormat)
+}
+
+// Returns the route to virtual destination vDest of agent pid in the running
+// configuration, and the box of its destination, which is "" if there is no
+// such route. Returns false if agent pid is not in the configuration anymore
+func lookupRoute(pid, vDest c.ProcessID) (c.Route, c.BoxID, bool) {
+	configMut.RLock()
+	defer configMut.RUnlock()
+	info, ok := gridConfig[pid]
+	if !ok {
+		return c.Route{}, "", false
+	}
+	rt := info.Routes[vDest]
+	if dest, ok := gridConfig[rt.DestID]; ok {
+		return rt, dest.Box, true
+	}
+	return rt, "", true
+}
+
+// Returns the set of boxes of config
+func boxesOf(config map[c.ProcessID]*a.AgentInfo) map[c.BoxID]bool {
+	boxes := make(map[c.BoxID]bool)
+	for _, info := range config {
+		boxes[info.Box] = true
+	}
+	return boxes
+}
+
+// Gives every agent that migrated the box it runs on, if newConfig gives it the
+// box it migrated from
+func keepMigrations(newConfig map[c.ProcessID]*a.AgentInfo) {
+	configMut.RLock()
+	defer configMut.RUnlock()
+	for pid, from := range movedFrom {
+		info, ok := newConfig[pid]
+		running, isRunning := gridConfig[pid]
+		if ok && isRunning && info.Box == from {
+			moved := *info
+			moved.Box = running.Box
+			newConfig[pid] = &moved
+		}
+	}
+}
+
+// Returns an error if newConfig cannot replace the running configuration
+func checkReload(newConfig map[c.ProcessID]*a.AgentInfo) error {
+	agents := localAgents()
+	configMut.RLock()
+	defer configMut.RUnlock()
+	oldBoxes, newBoxes := boxesOf(gridConfig), boxesOf(newConfig)
+	for pid, info := range newConfig {
+		if _, ok := gridConfig[pid]; !ok && oldBoxes[info.Box] {
+			return fmt.Errorf("agent %d is added to running box %s", pid, info.Box)
+		}
+	}
+	for pid, info := range gridConfig {
+		newInfo, ok := newConfig[pid]
+		switch {
+		case !ok && newBoxes[info.Box]:
+			return fmt.Errorf("agent %d is removed from box %s, which stays", pid, info.Box)
+		case !ok:
+			// removed with its box
+			continue
+		case newInfo.Type != info.Type:
+			return fmt.Errorf("agent %d changes type", pid)
+		case newInfo.Box != info.Box:
+			return fmt.Errorf("agent %d moves from box %s to box %s", pid, info.Box, newInfo.Box)
+		}
+		if agent, ok := agents[pid]; ok && !reflect.DeepEqual(info.RawAttrs, newInfo.RawAttrs) {
+			if _, ok := (*agent).(a.Reconfigurable); !ok {
+				return fmt.Errorf("attrs of agent %d cannot change while it runs", pid)
+			}
+		}
+	}
+	return nil
+}
+
+// Replaces the running configuration with the one at path, and forwards the
+// reload to the other boxes
+func reload(path string) error {
+	format, err := conf.Format(path)
+	if err != nil {
+		return err
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return reloadData(dat, format, path, true)
+}
+
+// Replaces the running configuration with dat, the contents of a configuration
+// file in format that comes from src, and forwards the reload to the other boxes
+// if forward is true
+func reloadData(dat []byte, format, src string, forward bool) error {
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+	newConfig, err := conf.TryParseData(dat, format)
+	if err != nil {
+		return fmt.Errorf("cannot reload %s: %v", src, err)
+	}
+	keepMigrations(newConfig)
+	if err := checkReload(newConfig); err != nil {
+		return fmt.Errorf("cannot reload %s: %v", src, err)
+	}
+	if forward {
+		if err := prepareReload(dat, format); err != nil {
+			return fmt.Errorf("cannot reload %s: %v", src, err)
+		}
+	}
+	oldBoxes, newBoxes := boxesOf(gridConfig), boxesOf(newConfig)
+	// Know the new boxes before their agents become routable, and drop the
+	// removed boxes after their agents are not
+	for bid := range newBoxes {
+		linkMgr.addBox(bid)
+		members.addBox(bid)
+	}
+	configMut.Lock()
+	oldConfig := gridConfig
+	gridConfig = newConfig
+	configData, configFormat = dat, format
+	for pid := range movedFrom {
+		if _, ok := newConfig[pid]; !ok {
+			delete(movedFrom, pid)
+		}
+	}
+	configMut.Unlock()
+	if forward {
+		linkMgr.broadcastControl(reloadMsg(dat, format))
+		// the reload comes from the file at src
+		superviseGrid(src, dat, format, newBoxes)
+	} else {
+		superviseGrid("", dat, format, newBoxes)
+	}
+	for bid := range oldBoxes {
+		if !newBoxes[bid] && bid != myBoxID {
+			debugPrintf("Box %v leaves the grid\n", bid)
+			linkMgr.removeBox(bid)
+			members.removeBox(bid)
+		}
+	}
+	debugPrintf("Reloaded configuration %s\n", src)
+	if !newBoxes[myBoxID] {
+		go drain()
+		return nil
+	}
+	// Reconfigure my agents once their routes are in place, and without holding
+	// configMut, since they may send
+	for pid, agent := range localAgents() {
+		if !reflect.DeepEqual(oldConfig[pid].RawAttrs, newConfig[pid].RawAttrs) {
+			(*agent).(a.Reconfigurable).Reconfigure(newConfig[pid].RawAttrs)
+		}
+	}
+	return nil
+}
+
+// Has every other box that is up validate dat, the contents of a configuration
+// file in format. Returns the first rejection, or an error if a box does not
+// answer within prepareTimeout
+func prepareReload(dat []byte, format string) error {
+	p := &preparation{waiting: make(map[c.BoxID]bool), done: make(chan error, 1)}
+	for _, bid := range linkMgr.getAllUp() {
+		if bid != myBoxID {
+			p.waiting[bid] = true
+		}
+	}
+	if len(p.waiting) == 0 {
+		return nil
+	}
+	boxes := keysOf(p.waiting)
+	prepareMut.Lock()
+	prepareSeq++
+	seq := prepareSeq
+	preparations[seq] = p
+	prepareMut.Unlock()
+	defer func() {
+		prepareMut.Lock()
+		delete(preparations, seq)
+		prepareMut.Unlock()
+	}()
+	msg := fmt.Sprintf("prepare %v %d %s %s", myBoxID, seq, format,
+		base64.StdEncoding.EncodeToString(dat))
+	for _, bid := range boxes {
+		linkMgr.sendControl(bid, msg)
+	}
+	select {
+	case err := <-p.done:
+		return err
+	case <-time.After(prepareTimeout):
+		prepareMut.Lock()
+		defer prepareMut.Unlock()
+		return fmt.Errorf("boxes %v did not validate the configuration", keysOf(p.waiting))
+	}
+}
+
+// Returns the boxes of set
+func keysOf(set map[c.BoxID]bool) []c.BoxID {
+	res := make([]c.BoxID, 0, len(set))
+	for bid := range set {
+		res = append(res, bid)
+	}
+	return res
+}
+
+// Handles the control message "prepare <src> <seq> <format> <base64 data>", which
+// has me validate a reload of box src. Validating does not take reloadMut, so
+// that two boxes that reload at once validate each other's reloads
+func handlePrepareMsg(data string) {
+	dataSlice := strings.SplitN(strings.TrimSpace(data), " ", 5)
+	if len(dataSlice) != 5 {
+		debugPrintf("Invalid prepare message '%s'\n", data)
+		return
+	}
+	dat, err := base64.StdEncoding.DecodeString(dataSlice[4])
+	var newConfig map[c.ProcessID]*a.AgentInfo
+	if err == nil {
+		newConfig, err = conf.TryParseData(dat, dataSlice[3])
+	}
+	if err == nil {
+		keepMigrations(newConfig)
+		err = checkReload(newConfig)
+	}
+	reply := "ok"
+	if err != nil {
+		reply = fmt.Sprintf("failed %v", err)
+	}
+	linkMgr.sendControl(c.BoxID(dataSlice[1]),
+		fmt.Sprintf("prepared %v %s %s", myBoxID, dataSlice[2], reply))
+}
+
+// Handles the control message "prepared <src> <seq> ok" or
+// "prepared <src> <seq> failed <error>", which answers my validation seq
+func handlePreparedMsg(data string) {
+	dataSlice := strings.SplitN(strings.TrimSpace(data), " ", 4)
+	if len(dataSlice) != 4 {
+		debugPrintf("Invalid prepared message '%s'\n", data)
+		return
+	}
+	src := c.BoxID(dataSlice[1])
+	seq, err := strconv.ParseUint(dataSlice[2], 10, 64)
+	if err != nil {
+		debugPrintf("Invalid prepared message '%s'\n", data)
+		return
+	}
+	prepareMut.Lock()
+	defer prepareMut.Unlock()
+	p, ok := preparations[seq]
+	if !ok || !p.waiting[src] {
+		return
+	}
+	delete(p.waiting, src)
+	var res error
+	switch {
+	case dataSlice[3] != "ok":
+		res = fmt.Errorf("box %v: %s", src, strings.TrimPrefix(dataSlice[3], "failed "))
+	case len(p.waiting) > 0:
+		return
+	}
+	select {
+	case p.done <- res:
+	default:
+		// already decided
+	}
+}
+
+// Has the supervisor of my agents start the boxes of the grid with configuration
+// dat in format, which is the file at path. If path is "", dat comes from another
+// box, and is written to a file of mine
+func superviseGrid(path string, dat []byte, format string, boxes map[c.BoxID]bool) {
+	if path == "" {
+		path = filepath.Join(os.TempDir(),
+			fmt.Sprintf("ovid_%s.%s", strings.Replace(string(myBoxID), ":", "_", -1), format))
+		if err := ioutil.WriteFile(path, dat, 0644); err != nil {
+			debugPrintf("Cannot write configuration %s: %v\n", path, err)
+			return
+		}
+	}
+	sup.SetGrid(path, boxes)
+}
+
+// Handles the control message "reload <src> <format> <base64 data>" of a reload
+// forwarded by box src
+func handleReloadMsg(data string) {
+	dataSlice := strings.SplitN(strings.TrimSpace(data), " ", 4)
+	if len(dataSlice) != 4 {
+		debugPrintf("Invalid reload message '%s'\n", data)
+		return
+	}
+	src := fmt.Sprintf("from box %s", dataSlice[1])
+	dat, err := base64.StdEncoding.DecodeString(dataSlice[3])
+	if err == nil {
+		err = reloadData(dat, dataSlice[2], src, false)
+	}
+	if err != nil {
+		fmt.Printf("Error : process %v : %v\n", myBoxID, err)
+	}
+}
+
+// Leaves the grid: delivers the messages in flight to my agents until every other
+// box dropped its link with me, or for drainTimeout at most, then halts my agents
+// and exits
+func drain() {
+	debugPrintf("Removed from the grid. Draining\n")
+	linkMgr.leave()
+	members.leave()
+	deadline := time.Now().Add(drainTimeout)
+	for len(linkMgr.getAllUp()) > 1 && time.Now().Before(deadline) {
+		time.Sleep(pingInterval)
+	}
+	for _, agent := range localAgents() {
+		(*agent).Halt()
+	}
+	shouldRun = false
+	debugPrintf("Drained. Terminating\n")
+	os.Exit(0)
+}
+
+// Responds to a "reload <path>" command from the master
+func doReload(path string) {
+	if err := reload(path); err != nil {
+		linkMgr.sendToMaster(fmt.Sprintf("reloaded failed %v", err))
+		return
+	}
+	linkMgr.sendToMaster("reloaded ok")
+}
+
+// Reloads my configuration file whenever I receive a SIGHUP
+func handleSIGHUP() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		if err := reload(configFile); err != nil {
+			fmt.Printf("Error : process %v : %v\n", myBoxID, err)
+		}
+	}
+}
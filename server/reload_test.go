@@ -0,0 +1,52 @@
+package server
+
+import (
+	"sync"
+	"testing"
+
+	a "github.com/TonyZhangND/GoOvid/agents"
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Returns a configuration of agents 1 and 2 on boxes 127.0.0.1:5000 and
+// 127.0.0.1:5001
+func testConfig() map[c.ProcessID]*a.AgentInfo {
+	return map[c.ProcessID]*a.AgentInfo{
+		1: {Type: a.Dummy, Box: "127.0.0.1:5000"},
+		2: {Type: a.Dummy, Box: "127.0.0.1:5001"},
+	}
+}
+
+// Tests that a reload of the configuration an agent migrated from keeps it on
+// the box it migrated to, while a reload may still not move an agent
+func TestReload_Migrated(t *testing.T) {
+	configMut = new(sync.RWMutex)
+	reloadMut = new(sync.Mutex)
+	agentsMut = new(sync.Mutex)
+	myAgents = make(map[c.ProcessID]*a.Agent)
+	movedFrom = make(map[c.ProcessID]c.BoxID)
+	gridConfig = testConfig()
+	setBox(2, "127.0.0.1:5001", "127.0.0.1:5000")
+
+	newConfig := testConfig()
+	keepMigrations(newConfig)
+	if err := checkReload(newConfig); err != nil {
+		t.Errorf("reload of the original configuration: %v", err)
+	}
+	if box := newConfig[2].Box; box != "127.0.0.1:5000" {
+		t.Errorf("agent 2 reloaded on box %s; want 127.0.0.1:5000", box)
+	}
+
+	newConfig = testConfig()
+	newConfig[1].Box = "127.0.0.1:5001"
+	keepMigrations(newConfig)
+	if err := checkReload(newConfig); err == nil {
+		t.Errorf("reload that moves agent 1 accepted")
+	}
+
+	// an agent that migrates back is home
+	setBox(2, "127.0.0.1:5000", "127.0.0.1:5001")
+	if len(movedFrom) != 0 {
+		t.Errorf("agent 2 migrated back, but moved from %v", movedFrom)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	a "github.com/TonyZhangND/GoOvid/agents"
@@ -27,6 +28,7 @@ var (
 	lossRate   float64
 	shouldRun  bool // loop condition for the server's routines
 	linkMgr    *linkManager
+	members    *membership
 	msgLog     *messageLog
 )
 
@@ -39,11 +41,10 @@ func serverInfo() string {
 		myBoxID, linkMgr.getAllKnown(), masterPort)
 }
 
-// Sends a message to phyDest
-func send(senderID, phyDest c.ProcessID, destPort c.PortNum, msg string) {
+// Sends a message to phyDest, which runs on destBox
+func send(senderID, phyDest c.ProcessID, destBox c.BoxID, destPort c.PortNum, msg string) {
 	// Check destination is valid
-	destAgent, ok := gridConfig[phyDest]
-	if !ok {
+	if destBox == "" {
 		fatalServerErrorf("Destination agent %v does not exist\n", phyDest)
 	}
 
@@ -54,10 +55,9 @@ func send(senderID, phyDest c.ProcessID, destPort c.PortNum, msg string) {
 	}
 
 	// Send the message
-	destBox := destAgent.Box
 	if destBox == myBoxID {
 		// if sending to agent on this box
-		(*myAgents[phyDest]).Deliver(msg, destPort)
+		deliver(senderID, phyDest, destPort, msg)
 	} else {
 		// else sending to agent on some other box
 		s := fmt.Sprintf("%d %d %d %s", senderID, phyDest, destPort, msg)
@@ -65,9 +65,39 @@ func send(senderID, phyDest c.ProcessID, destPort c.PortNum, msg string) {
 	}
 }
 
+// Tells my agent pid, if it implements agents.PeerObserver, that the agents it
+// routes to on box bid went up or down
+func notifyPeerStatus(pid c.ProcessID, agent *a.Agent, bid c.BoxID, up bool) {
+	obs, ok := (*agent).(a.PeerObserver)
+	if !ok {
+		return
+	}
+	peers := make([]c.ProcessID, 0)
+	configMut.RLock()
+	if info, ok := gridConfig[pid]; ok {
+		for vDest, rt := range info.Routes {
+			if dest, ok := gridConfig[rt.DestID]; ok && dest.Box == bid {
+				peers = append(peers, vDest)
+			}
+		}
+	}
+	configMut.RUnlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	for _, vDest := range peers {
+		obs.OnPeerStatus(vDest, up)
+	}
+}
+
+// Tells all my agents that box bid went up or down
+func notifyAllPeerStatus(bid c.BoxID, up bool) {
+	for pid, agent := range localAgents() {
+		notifyPeerStatus(pid, agent, bid, up)
+	}
+}
+
 // Responds to an "alive" command from the master
 func doAlive() {
-	aliveSet := linkMgr.getAllUp()
+	aliveSet := members.getAllAlive()
 	sort.Slice(aliveSet,
 		func(i, j int) bool { return aliveSet[i] < aliveSet[j] })
 	rep := make([]string, len(aliveSet))
@@ -102,9 +132,21 @@ func handleMasterMsg(data string) {
 	case "broadcast":
 		payload := dataSlice[1]
 		doBroadcast(payload)
+	case "reload":
+		if len(dataSlice) < 2 {
+			linkMgr.sendToMaster("reloaded failed missing configuration path")
+			return
+		}
+		doReload(strings.TrimSpace(dataSlice[1]))
+	case "migrate":
+		if len(dataSlice) < 2 {
+			linkMgr.sendToMaster("migrated failed usage: migrate <pid> <box>")
+			return
+		}
+		doMigrate(dataSlice[1])
 	case "crash":
 		// self-destruct
-		for _, agent := range myAgents {
+		for _, agent := range localAgents() {
 			(*agent).Halt()
 		}
 		shouldRun = false
@@ -116,21 +158,30 @@ func handleMasterMsg(data string) {
 
 // Handles messages from a server
 func handleServerMsg(data string) {
-	if strings.SplitN(data, " ", 2)[0] == "chatroom" {
+	switch strings.SplitN(data, " ", 2)[0] {
+	case "chatroom":
 		// if for chatroom project
 		dataSlice := strings.SplitN(strings.TrimSpace(data), " ", 3)
 		// senderBox := dataSlice[1]
 		msgLog.appendMsg(dataSlice[2])
-	} else {
+	case "reload":
+		handleReloadMsg(data)
+	case "prepare":
+		handlePrepareMsg(data)
+	case "prepared":
+		handlePreparedMsg(data)
+	case "migrate", "migrated", "abort", "moved":
+		handleMigrationMsg(data)
+	default:
 		// else a GoOvid message to deliver to an agent
 		dataSlice := strings.SplitN(data, " ", 4)
-		_, err := strconv.ParseInt(dataSlice[0], 10, 16) //ignore sender for now
+		senderID, err := strconv.ParseInt(dataSlice[0], 10, 16)
 		checkFatalServerErrorf(err, "Cannot parse sender of incoming message '%s'\n", data)
 		destID, err := strconv.ParseInt(dataSlice[1], 10, 16)
 		checkFatalServerErrorf(err, "Cannot parse destID of incoming message '%s'\n", data)
 		destPort, err := strconv.ParseInt(dataSlice[2], 10, 16)
 		checkFatalServerErrorf(err, "Cannot parse destPort of incoming message '%s'\n", data)
-		(*myAgents[c.ProcessID(destID)]).Deliver(dataSlice[3], c.PortNum(destPort))
+		deliver(c.ProcessID(senderID), c.ProcessID(destID), c.PortNum(destPort), dataSlice[3])
 	}
 }
 
@@ -161,57 +212,68 @@ func initAgents() map[c.ProcessID]*a.Agent {
 	myAg := make(map[c.ProcessID]*a.Agent)
 	for k, agentInfo := range gridConfig {
 		if agentInfo.Box == myBoxID {
-			// allocate the struct
-			ag := a.NewAgent(agentInfo.Type)
-			myAg[k] = &ag
+			myAg[k] = initAgent(k)
 		}
 	}
-	// Initialize and run each agent on this box
-	for agentID, agent := range myAg {
-		// Notice that for each of the following closures, we are implementing a closure
-		// generator rather than a closure itself. This is because in Go, variables
-		// declared in for loops are passed by reference. In other words, bad
-		// things happen when you use a loop variable in the closure, because those values
-		// can change from underneath you, and the closure is then messed up.
-		// However, fuction params are passed by value. Thus, we use this generator
-		// technique to "freeze" the agentID variable for each closure, for each agent.
+	return myAg
+}
+
+// Helper: allocates and initializes agent agentID of the running configuration
+func initAgent(agentID c.ProcessID) *a.Agent {
+	configMut.RLock()
+	agentInfo := gridConfig[agentID]
+	configMut.RUnlock()
+	// allocate the struct
+	ag := a.NewAgent(agentInfo.Type)
+	agent := &ag
+
+	// Notice that for each of the following closures, we are implementing a closure
+	// generator rather than a closure itself. This is because in Go, variables
+	// declared in for loops are passed by reference. In other words, bad
+	// things happen when you use a loop variable in the closure, because those values
+	// can change from underneath you, and the closure is then messed up.
+	// However, fuction params are passed by value. Thus, we use this generator
+	// technique to "freeze" the agentID variable for each closure, for each agent.
 
-		// Create custom send func using closure
-		sendFuncGen := func(id c.ProcessID) func(vDest c.ProcessID, msg string) {
-			return func(vDest c.ProcessID, msg string) {
-				phyDest := gridConfig[id].Routes[vDest].DestID
-				destPort := gridConfig[id].Routes[vDest].DestPort
-				send(id, phyDest, destPort, msg)
+	// Create custom send func using closure
+	sendFuncGen := func(id c.ProcessID) func(vDest c.ProcessID, msg string) {
+		return func(vDest c.ProcessID, msg string) {
+			route, destBox, ok := lookupRoute(id, vDest)
+			if !ok {
+				// I was removed from the grid, and am draining
+				return
 			}
+			send(id, route.DestID, destBox, route.DestPort, msg)
 		}
-		// Create custom error func using closure
-		fatalAgentErrorfGen := func(id c.ProcessID) func(s string, a ...interface{}) {
-			return func(s string, a ...interface{}) {
-				errMsg := fmt.Sprintf(s, a...)
-				fmt.Printf("Error : Agent %v : %s", id, errMsg)
-				debug.PrintStack()
-				(*agent).Halt()
-			}
+	}
+	// Create custom error func using closure
+	fatalAgentErrorfGen := func(id c.ProcessID) func(s string, a ...interface{}) {
+		return func(s string, a ...interface{}) {
+			errMsg := fmt.Sprintf(s, a...)
+			fmt.Printf("Error : Agent %v : %s", id, errMsg)
+			debug.PrintStack()
+			(*agent).Halt()
 		}
-		// Create custom debugPrintf func using closure
-		agentDebugPrintfGen := func(id c.ProcessID) func(s string, a ...interface{}) {
-			return func(s string, a ...interface{}) {
-				msg := fmt.Sprintf("Agent %v : %s", id, s)
-				debugPrintf(msg, a...)
-			}
+	}
+	// Create custom debugPrintf func using closure
+	agentDebugPrintfGen := func(id c.ProcessID) func(s string, a ...interface{}) {
+		return func(s string, a ...interface{}) {
+			msg := fmt.Sprintf("Agent %v : %s", id, s)
+			debugPrintf(msg, a...)
 		}
-		// Initialize the agent
-		(*agent).Init(gridConfig[agentID].RawAttrs,
-			sendFuncGen(agentID),
-			fatalAgentErrorfGen(agentID),
-			agentDebugPrintfGen(agentID))
 	}
-	return myAg
+	// Initialize the agent
+	(*agent).Init(agentInfo.RawAttrs,
+		sendFuncGen(agentID),
+		fatalAgentErrorfGen(agentID),
+		agentDebugPrintfGen(agentID))
+	return agent
 }
 
 // InitAndRunServer is the main method of a server
 func InitAndRunServer(
 	boxID c.BoxID,
+	configPath string, // file of config, reloaded on SIGHUP
 	config map[c.ProcessID]*a.AgentInfo,
 	mstrPort c.PortNum, // 0 if master conn not specified
 	loss float64) {
@@ -232,6 +294,17 @@ func InitAndRunServer(
 
 	// Populate the global variables and start the linkManager
 	gridConfig = config
+	configFile = configPath
+	readConfigData()
+	configMut = new(sync.RWMutex)
+	reloadMut = new(sync.Mutex)
+	prepareMut = new(sync.Mutex)
+	preparations = make(map[uint64]*preparation)
+	agentsMut = new(sync.Mutex)
+	agentsCond = sync.NewCond(agentsMut)
+	inflight = make(map[c.ProcessID]int)
+	migrations = make(map[c.ProcessID]*migration)
+	movedFrom = make(map[c.ProcessID]c.BoxID)
 	myBoxID = boxID
 	masterIP = "127.0.0.1"
 	masterPort = mstrPort
@@ -243,14 +316,29 @@ func InitAndRunServer(
 		getAllBoxes(),
 		serverInChan,
 		masterInChan)
+	members = newMembership(getAllBoxes())
+	members.subscribe(func(bid c.BoxID, up bool) {
+		if up {
+			debugPrintf("Box %v is up\n", bid)
+		} else {
+			debugPrintf("Box %v is down\n", bid)
+			linkMgr.markAsDead(bid)
+		}
+	})
+	members.subscribe(notifyAllPeerStatus)
 	msgLog = newMessageLog()
 	debugPrintf("Launching server...\n")
 	linkMgr.run()
 	time.Sleep(1 * time.Second)
-	debugPrintf(serverInfo())
+	debugPrintf("%s", serverInfo())
 
 	// Initialize my agents
-	myAgents = initAgents()
+	agents := initAgents()
+	agentsMut.Lock()
+	myAgents = agents
+	agentsMut.Unlock()
+	// Start the membership once my agents can observe it
+	members.run()
 
 	// main loop
 	if masterPort > 0 {
@@ -271,9 +359,10 @@ func InitAndRunServer(
 		}()
 	}
 	// run my agents
-	for _, agent := range myAgents {
+	for _, agent := range localAgents() {
 		go (*agent).Run()
 	}
+	go handleSIGHUP()
 	for shouldRun {
 		handleServerMsg(<-serverInChan)
 	}
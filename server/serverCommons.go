@@ -21,6 +21,10 @@ var DebugMode = false
 // LogFile turns on logging when initialized
 var LogFile = ""
 
+// Joining is true iff the box joins a running grid, i.e. announces its
+// configuration to the boxes of the grid until all of them know it
+var Joining = false
+
 // DebugPrintln prints the string s if debug mode is on
 func debugPrintf(s string, a ...interface{}) {
 	if DebugMode {
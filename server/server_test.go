@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	a "github.com/TonyZhangND/GoOvid/agents"
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// An agent that records the peer statuses it learns
+type observerAgent struct {
+	a.DummyAgent
+	statuses []string
+}
+
+func (oa *observerAgent) OnPeerStatus(pid c.ProcessID, up bool) {
+	oa.statuses = append(oa.statuses, fmt.Sprintf("%d %v", pid, up))
+}
+
+// Tests that an agent learns the status of the agents it routes to on a box, by
+// their virtual IDs
+func TestServer_PeerStatus(t *testing.T) {
+	configMut = new(sync.RWMutex)
+	gridConfig = map[c.ProcessID]*a.AgentInfo{
+		1: {Box: "127.0.0.1:5000", Routes: map[c.ProcessID]c.Route{
+			10: {DestID: 2}, 11: {DestID: 3}, 12: {DestID: 4}}},
+		2: {Box: "127.0.0.1:5001"},
+		3: {Box: "127.0.0.1:5002"},
+		4: {Box: "127.0.0.1:5001"},
+	}
+	oa := &observerAgent{}
+	var agent a.Agent = oa
+	notifyPeerStatus(1, &agent, "127.0.0.1:5001", false)
+	notifyPeerStatus(1, &agent, "127.0.0.1:5002", true)
+	if got, want := fmt.Sprint(oa.statuses), "[10 false 12 false 11 true]"; got != want {
+		t.Errorf("agent learned %s; want %s", got, want)
+	}
+}
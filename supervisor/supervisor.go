@@ -0,0 +1,240 @@
+package supervisor
+
+// This file contains a supervisor of the boxes of a grid, for controller agents that
+// start and kill boxes, e.g. to inject failures.
+// The supervisor runs each box as a child ovid process, with the executable and the
+// configuration of the running process, which follows the reloads of the grid. It
+// waits on every child, so that it learns when and how a box exits, and may restart
+// boxes that crash, i.e. that exit with an error.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// The grid of the running ovid process, see SetGrid
+var (
+	gridConfig string           // path to the configuration file
+	gridBoxes  map[c.BoxID]bool // boxes of the configuration
+	gridMut    = new(sync.RWMutex)
+)
+
+// SetGrid sets the grid of the running ovid process to the configuration at path,
+// of the given boxes. It is called by main before the agents are initialized, and
+// by the server whenever the configuration is reloaded
+func SetGrid(path string, boxes map[c.BoxID]bool) {
+	gridMut.Lock()
+	defer gridMut.Unlock()
+	gridConfig = path
+	gridBoxes = make(map[c.BoxID]bool, len(boxes))
+	for box := range boxes {
+		gridBoxes[box] = true
+	}
+}
+
+// Returns the path to the configuration of the grid, and whether box is in it
+func gridHas(box c.BoxID) (string, bool) {
+	gridMut.RLock()
+	defer gridMut.RUnlock()
+	return gridConfig, gridBoxes[box]
+}
+
+// Delay before a crashed box is restarted
+const restartDelay = 1 * time.Second
+
+// a child is a box started by the supervisor
+type child struct {
+	cmd     *exec.Cmd
+	flags   []string
+	stopped bool          // true iff the supervisor killed the box on purpose
+	done    chan struct{} // closed once the process has exited
+}
+
+// Supervisor starts, stops and watches the boxes of the grid
+type Supervisor struct {
+	// Restart is true iff boxes that exit with an error without being stopped are
+	// restarted. A box that exits with status 0, e.g. once drained, is not
+	Restart bool
+	// OnExit, if non-nil, is called whenever a box exits, with the error returned by
+	// its Wait, which is nil iff it exited with status 0
+	OnExit func(box c.BoxID, err error)
+
+	binary   string
+	children map[c.BoxID]*child
+	mut      *sync.Mutex // mutex for children
+}
+
+// New returns a supervisor of the boxes of the grid
+func New() (*Supervisor, error) {
+	gridMut.RLock()
+	config := gridConfig
+	gridMut.RUnlock()
+	if config == "" {
+		return nil, fmt.Errorf("grid configuration is unknown")
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &Supervisor{
+		binary:   binary,
+		children: make(map[c.BoxID]*child),
+		mut:      new(sync.Mutex)}, nil
+}
+
+// Resolve returns the box of the grid denoted by str, which is either a box
+// address, or a port number that a single box of the grid listens on
+func (s *Supervisor) Resolve(str string) (c.BoxID, error) {
+	if strings.Contains(str, ":") {
+		if _, ok := gridHas(c.BoxID(str)); !ok {
+			return "", fmt.Errorf("box %s is not in the grid", str)
+		}
+		return c.BoxID(str), nil
+	}
+	port, err := strconv.ParseUint(str, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid box or port '%s'", str)
+	}
+	matches := make([]c.BoxID, 0)
+	for _, box := range s.Boxes() {
+		i := strings.LastIndex(string(box), ":")
+		if p, err := strconv.ParseUint(string(box)[i+1:], 10, 16); err == nil && p == port {
+			matches = append(matches, box)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no box of the grid listens on port %d", port)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("several boxes of the grid listen on port %d", port)
+	}
+}
+
+// Boxes returns the boxes of the grid, sorted
+func (s *Supervisor) Boxes() []c.BoxID {
+	gridMut.RLock()
+	boxes := make([]c.BoxID, 0, len(gridBoxes))
+	for box := range gridBoxes {
+		boxes = append(boxes, box)
+	}
+	gridMut.RUnlock()
+	sort.Slice(boxes, func(i, j int) bool { return boxes[i] < boxes[j] })
+	return boxes
+}
+
+// Start starts box with the given ovid flags, and returns the pid of its process
+func (s *Supervisor) Start(box c.BoxID, flags ...string) (int, error) {
+	if _, ok := gridHas(box); !ok {
+		return 0, fmt.Errorf("box %s is not in the grid", box)
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.children[box]; ok {
+		return 0, fmt.Errorf("box %s is already running", box)
+	}
+	return s.spawn(box, flags)
+}
+
+// Starts the process of box with the configuration of the grid, and the thread
+// that waits on it. Caller holds s.mut
+func (s *Supervisor) spawn(box c.BoxID, flags []string) (int, error) {
+	config, _ := gridHas(box)
+	args := append(append([]string{}, flags...), config, string(box))
+	cmd := exec.Command(s.binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	ch := &child{cmd: cmd, flags: flags, done: make(chan struct{})}
+	s.children[box] = ch
+	go s.wait(box, ch)
+	return cmd.Process.Pid, nil
+}
+
+// Waits for the process of ch to exit, and restarts it if it crashed while it is
+// still in the grid
+func (s *Supervisor) wait(box c.BoxID, ch *child) {
+	err := ch.cmd.Wait()
+	s.mut.Lock()
+	if s.children[box] == ch {
+		delete(s.children, box)
+	}
+	stopped := ch.stopped
+	s.mut.Unlock()
+	close(ch.done)
+	if s.OnExit != nil {
+		s.OnExit(box, err)
+	}
+	if stopped || !s.Restart || err == nil {
+		return
+	}
+	time.Sleep(restartDelay)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.children[box]; ok {
+		// restarted by hand meanwhile
+		return
+	}
+	if _, ok := gridHas(box); !ok {
+		// removed from the grid meanwhile
+		return
+	}
+	s.spawn(box, ch.flags)
+}
+
+// Stop kills box, and returns once its process has exited
+func (s *Supervisor) Stop(box c.BoxID) error {
+	s.mut.Lock()
+	ch, ok := s.children[box]
+	if !ok {
+		s.mut.Unlock()
+		return fmt.Errorf("box %s is not running", box)
+	}
+	ch.stopped = true
+	s.mut.Unlock()
+	// Kill fails iff the process already exited, which done tells anyway
+	ch.cmd.Process.Kill()
+	<-ch.done
+	return nil
+}
+
+// StopAll kills every box that is running
+func (s *Supervisor) StopAll() {
+	for _, box := range s.Running() {
+		s.Stop(box)
+	}
+}
+
+// Running returns the boxes that are running, sorted
+func (s *Supervisor) Running() []c.BoxID {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	boxes := make([]c.BoxID, 0, len(s.children))
+	for box := range s.children {
+		boxes = append(boxes, box)
+	}
+	sort.Slice(boxes, func(i, j int) bool { return boxes[i] < boxes[j] })
+	return boxes
+}
+
+// Pid returns the pid of the process of box, and whether it is running
+func (s *Supervisor) Pid(box c.BoxID) (int, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	ch, ok := s.children[box]
+	if !ok {
+		return 0, false
+	}
+	return ch.cmd.Process.Pid, true
+}
@@ -1,8 +1,10 @@
 package configs
 
 import (
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"reflect"
 	"testing"
 
 	a "github.com/TonyZhangND/GoOvid/agents"
@@ -81,6 +83,59 @@ func TestParser_Chat(t *testing.T) {
 	}
 }
 
+// Tests that the groups of paxos_groups.json expand to the agents that the
+// generator lists by hand
+func TestParser_Groups(t *testing.T) {
+	res := p.Parse("../../configs/paxos_groups.json")
+
+	cfg, err := p.GeneratePaxos(&p.PaxosOptions{F: 1, Clients: 2, Mode: "script"},
+		&p.GenOptions{PortBase: 5000, IP: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("generator failed: %v", err)
+	}
+	f, err := ioutil.TempFile("", "paxos_*.json")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if err := cfg.Write(f.Name()); err != nil {
+		t.Fatalf("%v", err)
+	}
+	want := p.Parse(f.Name())
+
+	if len(res) != len(want) {
+		t.Errorf("groups expand to %d agents; want %d", len(res), len(want))
+	}
+	for pid, agent := range want {
+		if got, ok := res[pid]; !ok || !reflect.DeepEqual(got, agent) {
+			t.Errorf("agent %d is %+v; want %+v", pid, got, agent)
+		}
+	}
+}
+
+// Tests that YAML and TOML configurations parse to the same agents as JSON
+func TestParser_Formats(t *testing.T) {
+	want := p.Parse("../../configs/kvs.json")
+	if got := p.Parse("../../configs/kvs.yaml"); !reflect.DeepEqual(got, want) {
+		t.Errorf("kvs.yaml parses to %v; want %v", got, want)
+	}
+
+	dir, err := ioutil.TempDir("", "configs")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, path := range []string{dir + "/kvs.toml", dir + "/kvs.yml", dir + "/kvs.json"} {
+		if err := p.Convert("../../configs/kvs.yaml", path); err != nil {
+			t.Fatalf("conversion to %s failed: %v", path, err)
+		}
+		if got := p.Parse(path); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s parses to %v; want %v", path, got, want)
+		}
+	}
+}
+
 // Tests if the parser catches issues in invalid configurations
 func TestParser_Invalid(t *testing.T) {
 	if os.Getenv("CRASHER") == "1" {
@@ -107,3 +162,53 @@ func TestParser_Invalid(t *testing.T) {
 	}
 	t.Fatalf("process ran with err %v, want exit status 1", err2)
 }
+
+// Tests that TryParse reports invalid configurations instead of exiting
+func TestParser_TryParse(t *testing.T) {
+	for _, path := range []string{"invalid1.json", "invalid2.json", "missing.json"} {
+		if _, err := p.TryParse(path); err == nil {
+			t.Errorf("invalid configuration %s accepted", path)
+		}
+	}
+	res, err := p.TryParse("../../configs/chat.json")
+	if err != nil {
+		t.Fatalf("chat.json rejected: %v", err)
+	}
+	if want := p.Parse("../../configs/chat.json"); !reflect.DeepEqual(res, want) {
+		t.Errorf("TryParse returns %v; want %v", res, want)
+	}
+}
+
+// Tests that the generator writes no invalid configuration
+func TestParser_WriteInvalid(t *testing.T) {
+	cfg := p.Config{10: &p.AgentSpec{Type: "chat", Box: "127.0.0.1:5000",
+		Routes: map[string]map[string]int{"20": {"20": 100}}}}
+	dir, err := ioutil.TempDir("", "configs")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/chat.json"
+	if err := cfg.Write(path); err == nil {
+		t.Errorf("configuration with a route to a missing agent written")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("invalid configuration left at %s", path)
+	}
+}
+
+// Tests that Convert reports invalid configurations instead of exiting
+func TestParser_ConvertInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configs")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/invalid1.yaml"
+	if err := p.Convert("invalid1.json", path); err == nil {
+		t.Errorf("invalid configuration converted")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("invalid configuration converted to %s", path)
+	}
+}
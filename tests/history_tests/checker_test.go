@@ -0,0 +1,58 @@
+package history
+
+import (
+	"testing"
+
+	h "github.com/TonyZhangND/GoOvid/history"
+)
+
+// Returns a completed operation of client 1
+func op(input, output string, call, ret int64) *h.Operation {
+	return &h.Operation{Client: 1, Input: input, Output: output, Call: call, Return: ret}
+}
+
+// Tests the checker on linearizable and non-linearizable kvs histories
+func TestCheck_KVS(t *testing.T) {
+	good := []*h.Operation{
+		op("put x 1", "putok", 0, 10),
+		op("get x", "getbad", 1, 5), // concurrent with the put
+		op("get x", "getok 1", 11, 12),
+		op("put y 2", "putok", 0, 1),
+		op("get y", "getok 2", 2, 3),
+	}
+	if ok, _ := h.Check(h.KVSModel, good); !ok {
+		t.Errorf("linearizable kvs history rejected")
+	}
+	bad := []*h.Operation{
+		op("put x 1", "putok", 0, 10),
+		op("get x", "getok 1", 11, 12),
+		op("get x", "getbad", 13, 14), // stale read
+	}
+	if ok, _ := h.Check(h.KVSModel, bad); ok {
+		t.Errorf("stale read in kvs history accepted")
+	}
+}
+
+// Tests the checker on log histories with pending operations
+func TestCheck_Log(t *testing.T) {
+	pending := &h.Operation{Client: 2, Input: "append b", Call: 3, Pending: true}
+	good := []*h.Operation{
+		op("append a", "0", 0, 2),
+		pending,
+		op("read", "2 b", 4, 5), // the pending append took effect
+	}
+	if ok, _ := h.Check(h.LogModel, good); !ok {
+		t.Errorf("linearizable log history rejected")
+	}
+	good[2] = op("read", "1 a", 4, 5) // the pending append did not take effect
+	if ok, _ := h.Check(h.LogModel, good); !ok {
+		t.Errorf("linearizable log history rejected")
+	}
+	bad := []*h.Operation{
+		op("append a", "0", 0, 2),
+		op("append b", "0", 3, 4), // index already taken
+	}
+	if ok, _ := h.Check(h.LogModel, bad); ok {
+		t.Errorf("log history with duplicate index accepted")
+	}
+}
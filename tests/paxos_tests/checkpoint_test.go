@@ -0,0 +1,36 @@
+package paxos
+
+import (
+	"strings"
+	"testing"
+)
+
+// Tests that a replica that installs the checkpoint of a peer resumes from it,
+// with the chat log and sessions of the peer
+func TestCheckpoint_Snapshot(t *testing.T) {
+	replicas := []interface{}{float64(1), float64(2)}
+	tr1 := newTestReplica(t, 1, replicas, map[string]interface{}{"checkpoint": float64(2)})
+	tr1.decide(0, "100 0 42 register")
+	tr1.decide(1, "100 2 0 a")
+	// replica 2 asks for slot 0 onwards, which replica 1 truncated
+	tr1.Deliver("fetch 2 0", 1)
+	sent := tr1.received(2)
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "snapshot ") {
+		t.Fatalf("replica 1 answered the fetch with %q; want a snapshot", sent)
+	}
+
+	tr2 := newTestReplica(t, 2, replicas, nil)
+	tr2.decide(3, "100 2 1 b")
+	tr2.Deliver(sent[0], 1)
+	tr2.decide(2, "100 2 0 a") // a duplicate of slot 1
+	// a stale snapshot is ignored
+	tr2.Deliver(sent[0], 1)
+
+	checkMessages(t, "replies", tr2.received(100), "committed 100 2 1 2 1")
+	d, log := tr2.dump(t)
+	checkMessages(t, "messages", log, "100, 0 : 'a'", "100, 1 : 'b'")
+	checkStatuses(t, d, "duplicate", "executed")
+	if d.SlotOut != 4 || d.Checkpoint != 2 {
+		t.Errorf("slotOut is %d and checkpoint %d; want 4 and 2", d.SlotOut, d.Checkpoint)
+	}
+}
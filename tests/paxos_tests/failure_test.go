@@ -0,0 +1,27 @@
+package paxos
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Tests that clients are not redirected to a leader whose box is down
+func TestFailureDetector_LeaderHint(t *testing.T) {
+	tr := newTestReplica(t, 1, []interface{}{float64(1), float64(2), float64(3)}, nil)
+	// adopt the ballot of leader 2
+	tr.Deliver("p1a 2 5 0", 1)
+	tr.received(2)
+
+	request := func(reqNum int, want ...string) {
+		t.Helper()
+		tr.Deliver(fmt.Sprintf("100 0 %d hello", reqNum), 2)
+		if got := tr.received(100); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("client received %v; want %v", got, want)
+		}
+	}
+	request(1, "redirect 100 0 1 2")
+	tr.OnPeerStatus(2, false)
+	request(2)
+	tr.OnPeerStatus(2, true)
+	request(3, "redirect 100 0 3 2")
+}
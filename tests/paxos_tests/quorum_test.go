@@ -0,0 +1,69 @@
+package paxos
+
+import (
+	"fmt"
+	"testing"
+
+	p "github.com/TonyZhangND/GoOvid/agents/paxos_chatroom"
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// Returns the attributes of paxos_replica 1 with the given replicas, acceptors
+// and quorums. A nil acceptors or quorums leaves the attribute out
+func replicaAttrs(replicas, acceptors []interface{}, quorums map[string]interface{}) map[string]interface{} {
+	attrs := map[string]interface{}{
+		"myid":     float64(1),
+		"replicas": replicas,
+		"output":   "replica_1.txt",
+	}
+	if acceptors != nil {
+		attrs["acceptors"] = acceptors
+	}
+	if quorums != nil {
+		attrs["quorums"] = quorums
+	}
+	return attrs
+}
+
+// Inits a paxos_replica with attrs, and returns the fatal errors it reports
+func initReplica(attrs map[string]interface{}) []string {
+	errs := make([]string, 0)
+	rep := &p.ReplicaAgent{}
+	rep.Init(attrs,
+		func(vDest c.ProcessID, msg string) {},
+		func(errMsg string, a ...interface{}) { errs = append(errs, fmt.Sprintf(errMsg, a...)) },
+		func(s string, a ...interface{}) {})
+	return errs
+}
+
+// Tests that quorums are validated against the acceptors, not the replicas
+func TestQuorums_Acceptors(t *testing.T) {
+	replicas := []interface{}{float64(1), float64(2)}
+	acceptors := []interface{}{float64(3), float64(4), float64(5)}
+	size := func(q1, q2 int) map[string]interface{} {
+		return map[string]interface{}{"type": "size", "q1": float64(q1), "q2": float64(q2)}
+	}
+	tests := []struct {
+		name      string
+		acceptors []interface{}
+		quorums   map[string]interface{}
+		valid     bool
+	}{
+		// q1 + q2 > 2 replicas, but the phase-1 and phase-2 quorums of 3
+		// acceptors need not intersect
+		{"size 1+2 of 3 acceptors", acceptors, size(1, 2), false},
+		{"size 2+2 of 3 acceptors", acceptors, size(2, 2), true},
+		{"size 1+2 of 2 replicas", nil, size(1, 2), true},
+		{"size 4+1 of 3 acceptors", acceptors, size(4, 1), false},
+		{"majority of 3 acceptors", acceptors, nil, true},
+	}
+	for _, test := range tests {
+		errs := initReplica(replicaAttrs(replicas, test.acceptors, test.quorums))
+		if test.valid && len(errs) > 0 {
+			t.Errorf("%s: rejected with %v", test.name, errs)
+		}
+		if !test.valid && len(errs) == 0 {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package paxos
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	p "github.com/TonyZhangND/GoOvid/agents/paxos_chatroom"
+	c "github.com/TonyZhangND/GoOvid/commons"
+)
+
+// A paxos_replica that records the messages it sends
+type testReplica struct {
+	*p.ReplicaAgent
+	output string
+	sent   map[c.ProcessID][]string // messages sent to each agent
+	smut   sync.Mutex               // mutex for sent
+}
+
+// Inits paxos_replica id of the given replicas, with additional attrs
+func newTestReplica(t *testing.T, id int, replicas []interface{},
+	attrs map[string]interface{}) *testReplica {
+	tr := &testReplica{
+		ReplicaAgent: &p.ReplicaAgent{},
+		output:       filepath.Join(t.TempDir(), fmt.Sprintf("replica_%d.txt", id)),
+		sent:         make(map[c.ProcessID][]string)}
+	allAttrs := map[string]interface{}{
+		"myid":     float64(id),
+		"replicas": replicas,
+		"output":   tr.output,
+	}
+	for k, v := range attrs {
+		allAttrs[k] = v
+	}
+	tr.Init(allAttrs,
+		func(vDest c.ProcessID, msg string) {
+			tr.smut.Lock()
+			defer tr.smut.Unlock()
+			tr.sent[vDest] = append(tr.sent[vDest], msg)
+		},
+		func(errMsg string, a ...interface{}) { t.Errorf(errMsg, a...) },
+		func(s string, a ...interface{}) {})
+	return tr
+}
+
+// Delivers the decision of request req, "<clientID> <epoch> <reqNum> <m>", in slot
+func (tr *testReplica) decide(slot uint64, req string) {
+	tr.Deliver(fmt.Sprintf("decision 1 1 %d %s", slot, req), 1)
+}
+
+// Returns and forgets the messages sent to agent id
+func (tr *testReplica) received(id c.ProcessID) []string {
+	tr.smut.Lock()
+	defer tr.smut.Unlock()
+	msgs := tr.sent[id]
+	delete(tr.sent, id)
+	return msgs
+}
+
+// Dumps the replica, and returns its structured dump and chat log
+func (tr *testReplica) dump(t *testing.T) (*p.Dump, []string) {
+	t.Helper()
+	tr.Deliver("dump", 9)
+	d, err := p.ReadDump(tr.output + ".json")
+	if err != nil {
+		t.Fatalf("Cannot read dump: %v", err)
+	}
+	log, err := ioutil.ReadFile(tr.output)
+	if err != nil {
+		t.Fatalf("Cannot read chat log: %v", err)
+	}
+	return d, strings.Split(strings.TrimSuffix(string(log), "\n"), "\n")
+}
+
+// Checks the statuses of the slots of dump d
+func checkStatuses(t *testing.T, d *p.Dump, want ...string) {
+	t.Helper()
+	statuses := make([]string, 0, len(d.Slots))
+	for _, s := range d.Slots {
+		statuses = append(statuses, s.Status)
+	}
+	if fmt.Sprint(statuses) != fmt.Sprint(want) {
+		t.Errorf("slots are %v; want %v", statuses, want)
+	}
+}
+
+// Checks that got, a list of messages, is want
+func checkMessages(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("%s are %q; want %q", what, got, want)
+	}
+}
+
+// Tests that decisions delivered concurrently, and several times each, are
+// executed once each and in slot order
+func TestReplica_ConcurrentDecisions(t *testing.T) {
+	const slots, senders = 1000, 4
+	tr := newTestReplica(t, 1, []interface{}{float64(1)}, map[string]interface{}{"checkpoint": float64(50)})
+	tr.decide(0, "100 0 42 register")
+	var wg sync.WaitGroup
+	start := make(chan bool)
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			// each sender decides its share of the slots, then all of them again
+			for s := i; s < 2*slots; s += senders {
+				slot := uint64(s%slots + 1)
+				tr.decide(slot, fmt.Sprintf("100 2 %d m%d", slot-1, slot-1))
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	want := make([]string, 0, slots)
+	replies := make([]string, 0, slots)
+	for rn := 0; rn < slots; rn++ {
+		want = append(want, fmt.Sprintf("100, %d : 'm%d'", rn, rn))
+		replies = append(replies, fmt.Sprintf("committed 100 2 %d 1 %d", rn, rn))
+	}
+	got := tr.received(100)[1:]
+	sort.Strings(got)
+	sort.Strings(replies)
+	checkMessages(t, "replies", got, replies...)
+	d, log := tr.dump(t)
+	checkMessages(t, "messages", log, want...)
+	if d.SlotOut != slots+1 {
+		t.Errorf("slotOut is %d; want %d", d.SlotOut, slots+1)
+	}
+}
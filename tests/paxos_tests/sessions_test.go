@@ -0,0 +1,56 @@
+package paxos
+
+import (
+	"testing"
+)
+
+// Tests that a request is executed once, even if decided in several slots and out
+// of order
+func TestSessions_Dedup(t *testing.T) {
+	tr := newTestReplica(t, 1, []interface{}{float64(1)}, nil)
+	tr.decide(0, "100 0 42 register")
+	tr.decide(1, "100 2 0 a")
+	tr.decide(3, "100 2 2 c")
+	tr.decide(2, "100 2 1 b")
+	// duplicates, one with another payload
+	tr.decide(4, "100 2 2 x")
+	tr.decide(5, "100 2 0 a")
+
+	checkMessages(t, "replies", tr.received(100),
+		"committed 100 0 42 1 2",
+		"committed 100 2 0 1 0",
+		"committed 100 2 1 1 1",
+		"committed 100 2 2 1 2")
+	d, log := tr.dump(t)
+	checkMessages(t, "messages", log, "100, 0 : 'a'", "100, 1 : 'b'", "100, 2 : 'c'")
+	checkStatuses(t, d, "registration", "executed", "executed", "executed", "duplicate", "duplicate")
+	if s := d.Sessions[100]; s == nil || s.Epoch != 2 || s.Floor != 3 {
+		t.Errorf("session of client 100 is %+v; want epoch 2 and floor 3", s)
+	}
+}
+
+// Tests that a registration ends the previous epoch of its client, and that only
+// requests of the current epoch of a registered client are executed
+func TestSessions_Epochs(t *testing.T) {
+	tr := newTestReplica(t, 1, []interface{}{float64(1)}, nil)
+	tr.decide(0, "100 2 0 a") // before the registration
+	tr.decide(1, "100 0 42 register")
+	tr.decide(2, "100 2 0 b")
+	tr.decide(3, "100 0 43 register")
+	tr.decide(4, "100 2 1 c") // of the ended epoch
+	tr.decide(5, "100 3 0 d")
+	tr.decide(6, "101 2 0 e") // of an unregistered client
+
+	checkMessages(t, "replies", tr.received(100),
+		"committed 100 0 42 1 2",
+		"committed 100 2 0 1 0",
+		"committed 100 0 43 1 3",
+		"committed 100 3 0 1 1")
+	d, log := tr.dump(t)
+	checkMessages(t, "messages", log, "100, 0 : 'b'", "100, 0 : 'd'")
+	checkStatuses(t, d, "skipped", "registration", "executed", "registration", "skipped",
+		"executed", "skipped")
+	if s := d.Sessions[100]; s == nil || s.Epoch != 3 || s.Nonce != 43 {
+		t.Errorf("session of client 100 is %+v; want epoch 3 of nonce 43", s)
+	}
+}